@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,6 +24,7 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/cbelsole/dsw/db"
+	"github.com/cbelsole/dsw/encryption"
 	"github.com/cbelsole/dsw/handlers"
 )
 
@@ -33,19 +38,77 @@ func main() {
 		log.Println("migrations completed successfully")
 	}
 
-	d, err := sql.Open("postgres", fmt.Sprintf("%s?sslmode=disable&timezone=UTC", os.Getenv("POSTGRES_URL")))
+	dbURL := fmt.Sprintf("%s?sslmode=disable&timezone=UTC", os.Getenv("POSTGRES_URL"))
+	d, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		log.Printf("unable to open db: %s\n", err)
 		os.Exit(1)
 	}
 
+	policy, err := processors.NewTargetPolicy(processors.TargetPolicyConfig{
+		Schemes:      envList("TARGET_SCHEMES"),
+		AllowCIDRs:   envList("TARGET_ALLOW_CIDRS"),
+		DenyCIDRs:    envList("TARGET_DENY_CIDRS"),
+		AllowHosts:   envList("TARGET_ALLOW_HOSTS"),
+		DenyHosts:    envList("TARGET_DENY_HOSTS"),
+		AllowPrivate: os.Getenv("ALLOW_PRIVATE_TARGETS") == "true",
+	})
+	if err != nil {
+		log.Printf("invalid target policy: %s\n", err)
+		os.Exit(1)
+	}
+
+	var clientConfig processors.ClientConfig
+	if err := loadConfig(os.Getenv("DELIVERY_CONFIG"), &clientConfig); err != nil {
+		log.Printf("unable to load delivery config: %s\n", err)
+		os.Exit(1)
+	}
+
+	var queues map[string]processors.QueueConfig
+	if err := loadConfig(os.Getenv("QUEUES_CONFIG"), &queues); err != nil {
+		log.Printf("unable to load queues config: %s\n", err)
+		os.Exit(1)
+	}
+
 	database := db.NewDB(d)
-	processor := processors.Job{DB: database, WorkerNum: 3, MaxRetries: 3}
+	if keyfile := os.Getenv("ENCRYPTION_KEYFILE"); keyfile != "" {
+		provider, err := encryption.NewLocalKeyProvider(keyfile)
+		if err != nil {
+			log.Printf("unable to load encryption keys: %s\n", err)
+			os.Exit(1)
+		}
+
+		database.Envelope = encryption.NewEnvelope(provider)
+		reencrypt := processors.Reencrypt{DB: database, Interval: time.Minute, BatchSize: 100}
+		reencrypt.Start()
+	}
+	processor, err := processors.New(processors.Config{
+		DB:         database,
+		WorkerNum:  3,
+		MaxRetries: 3,
+		Policy:     policy,
+		Client:     clientConfig,
+		ListenURL:  dbURL,
+
+		ReservedWorkers: envInt("RESERVED_WORKERS"),
+		HighPriority:    envInt("HIGH_PRIORITY"),
+		Queues:          queues,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if err := processor.Start(); err != nil {
 		log.Fatal(err)
 	}
 
-	h := handlers.Handler{DB: database, Job: processor}
+	h := handlers.Handler{
+		DB:        database,
+		Scheduler: processor,
+		Admin:     processor,
+		MaxPast:   envDuration("EXECUTE_AT_MAX_PAST", time.Hour),
+		MaxFuture: envDuration("EXECUTE_AT_MAX_FUTURE", 365*24*time.Hour),
+	}
 	r := mux.NewRouter()
 	r.Use(handlers.RecoveryMiddleware, handlers.LoggingMiddleware)
 
@@ -53,9 +116,36 @@ func main() {
 	r.HandleFunc("/", h.HealthHandler).Methods("GET")
 	r.HandleFunc("/health", h.HealthHandler).Methods("GET")
 
+	// admin
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(handlers.AdminMiddleware(os.Getenv("ADMIN_TOKEN")))
+	admin.HandleFunc("/circuit-breakers", h.ListCircuitBreakers).Methods("GET")
+	admin.HandleFunc("/queues", h.ListQueues).Methods("GET")
+	admin.HandleFunc("/pauses", h.ListPauses).Methods("GET")
+	admin.HandleFunc("/pause", h.Pause).Methods("POST")
+	admin.HandleFunc("/resume", h.Resume).Methods("POST")
+
+	// metrics name the hosts of every tenant's jobs so they are admin only
+	admin.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+
+	// every other route is scoped to the tenant authenticated by its API
+	// key. It is registered last since this version of mux skips the
+	// middleware of routes matched after a subrouter that did not match.
+	api := r.NewRoute().Subrouter()
+	api.Use(h.TenantMiddleware)
+
 	// jobs
-	r.HandleFunc("/jobs", h.CreateJob).Methods("POST")
-	r.HandleFunc("/jobs", h.ListJobs).Methods("GET")
+	api.HandleFunc("/jobs", h.CreateJob).Methods("POST")
+	api.HandleFunc("/jobs", h.ListJobs).Methods("GET")
+	api.HandleFunc("/jobs/{id}", h.GetJob).Methods("GET")
+	api.HandleFunc("/jobs/{id}", h.CancelJob).Methods("DELETE")
+
+	// events
+	api.HandleFunc("/events", h.StreamEvents).Methods("GET")
+
+	// credentials
+	api.HandleFunc("/credentials", h.SaveCredential).Methods("POST")
+	api.HandleFunc("/credentials", h.ListCredentials).Methods("GET")
 
 	server := http.Server{
 		Handler:      r,
@@ -71,10 +161,12 @@ func main() {
 		}
 	}()
 
-	graceful(&server, 5*time.Second)
+	graceful(&server, processor, 30*time.Second)
 }
 
-func graceful(hs *http.Server, timeout time.Duration) {
+// graceful stops accepting requests and then stops the processor once a
+// signal is received
+func graceful(hs *http.Server, processor *processors.Job, timeout time.Duration) {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
@@ -88,6 +180,72 @@ func graceful(hs *http.Server, timeout time.Duration) {
 	} else {
 		log.Println("Server stopped")
 	}
+
+	if err := processor.Stop(ctx); err != nil {
+		log.Printf("Error: %v\n", err)
+	} else {
+		log.Println("Processor stopped")
+	}
+}
+
+// loadConfig reads a config from a JSON file into v. An empty filename leaves
+// v with its defaults.
+func loadConfig(filename string, v interface{}) error {
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// envList splits a comma separated environment variable
+func envList(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// envInt parses an integer environment variable, exiting if it is invalid.
+// Unset variables are 0.
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid %s: %s\n", name, err)
+		os.Exit(1)
+	}
+
+	return i
+}
+
+// envDuration parses a duration environment variable like "1h", exiting if it
+// is invalid. Unset variables use def.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid %s: %s\n", name, err)
+		os.Exit(1)
+	}
+
+	return d
 }
 
 func runMigrations() error {
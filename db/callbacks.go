@@ -0,0 +1,173 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+	"github.com/helloeave/json"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+)
+
+type callback struct {
+	ID            uuid.UUID       `db:"id"`
+	TenantID      string          `db:"tenant_id"`
+	JobID         uuid.UUID       `db:"job_id"`
+	URI           string          `db:"uri"`
+	Event         json.RawMessage `db:"event"`
+	Try           int             `db:"try"`
+	NextAttemptAt time.Time       `db:"next_attempt_at"`
+	KeyID         *string         `db:"key_id"`
+	DataKey       []byte          `db:"data_key"`
+	CreatedAt     time.Time       `db:"created_at"`
+}
+
+// createCallback queues an event for the job's callback URI unless it is not
+// sent that event. The event is sealed like the job since it carries the
+// job's response.
+func (db *DB) createCallback(tx *sqlx.Tx, job *types.Job, eventType string) error {
+	if !job.Notifies(eventType) {
+		return nil
+	}
+
+	event := types.NewEvent(eventType, job)
+	b, err := json.MarshalSafeCollections(event)
+	if err != nil {
+		return err
+	}
+
+	dk, err := db.newDataKey()
+	if err != nil {
+		return err
+	}
+	if b, err = sealJSON(dk, b); err != nil {
+		return err
+	}
+	keyID, dataKey := dataKeyColumns(dk)
+
+	_, err = tx.Exec(
+		"INSERT into callbacks (id,tenant_id,job_id,uri,event,key_id,data_key) VALUES ($1,$2,$3,$4,$5,$6,$7)",
+		event.ID, job.TenantID, job.ID, *job.CallbackURI, json.RawMessage(b), keyID, dataKey,
+	)
+	return err
+}
+
+// ClaimCallbacks gets up to limit callbacks that are due and pushes their next
+// attempt back by ttl so that no other instance sends them in the meantime.
+// Callbacks that cannot be decrypted, e.g. because their key is missing from
+// the keyfile, are logged and skipped until they are due again. It is meant
+// for the processor only.
+func (db *DB) ClaimCallbacks(limit int, ttl time.Duration) ([]*types.Callback, error) {
+	var rows []*callback
+	if err := db.DB.Select(
+		&rows,
+		"UPDATE callbacks set next_attempt_at = now() + $2 * interval '1 millisecond' where id IN (SELECT id from callbacks where next_attempt_at <= now() ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED) RETURNING *",
+		limit, int64(ttl/time.Millisecond),
+	); err != nil {
+		return nil, err
+	}
+
+	callbacks := make([]*types.Callback, 0, len(rows))
+	for _, row := range rows {
+		event, err := db.decodeEvent(row)
+		if err != nil {
+			log.Printf("skipping callback %s for job %s: %s\n", row.ID, row.JobID, err)
+			continue
+		}
+
+		callbacks = append(callbacks, &types.Callback{TenantID: row.TenantID, URI: row.URI, Event: event, Try: row.Try})
+	}
+
+	return callbacks, nil
+}
+
+// openEvent decrypts a callback's event with the row's data key
+func (db *DB) openEvent(row *callback) ([]byte, error) {
+	dk, err := db.openDataKey(row.KeyID, row.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return openJSON(dk, row.Event)
+}
+
+// decodeEvent decrypts and decodes a callback's event
+func (db *DB) decodeEvent(row *callback) (*types.Event, error) {
+	raw, err := db.openEvent(row)
+	if err != nil {
+		return nil, err
+	}
+
+	var event types.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// RetryCallback counts a failed attempt to send a callback and sets when it is
+// attempted next
+func (db *DB) RetryCallback(id uuid.UUID, nextAttemptAt time.Time) error {
+	_, err := db.DB.Exec("UPDATE callbacks set try = try + 1, next_attempt_at = $1 where id = $2", nextAttemptAt, id)
+	return err
+}
+
+// DeleteCallback removes a callback once it was sent or given up on
+func (db *DB) DeleteCallback(id uuid.UUID) error {
+	_, err := db.DB.Exec("DELETE from callbacks where id = $1", id)
+	return err
+}
+
+// ReencryptCallbacks re-encrypts up to limit callbacks with ids after after
+// that are in plain text or encrypted under an old key with the current key.
+// It returns the id of the last callback read, uuid.Nil once there are none
+// left, and the number of callbacks re-encrypted. Callbacks that cannot be
+// decrypted are logged and skipped.
+func (db *DB) ReencryptCallbacks(after uuid.UUID, limit int) (uuid.UUID, int, error) {
+	keyID := db.currentKeyID()
+	if keyID == nil {
+		return uuid.Nil, 0, nil
+	}
+
+	var rows []*callback
+	if err := db.DB.Select(&rows, "SELECT * from callbacks where key_id IS DISTINCT FROM $1 AND id > $2 ORDER BY id LIMIT $3", *keyID, after, limit); err != nil {
+		return uuid.Nil, 0, err
+	}
+	if len(rows) == 0 {
+		return uuid.Nil, 0, nil
+	}
+	last := rows[len(rows)-1].ID
+
+	count := 0
+	for _, row := range rows {
+		raw, err := db.openEvent(row)
+		if err != nil {
+			log.Printf("skipping re-encryption of callback %s for job %s: %s\n", row.ID, row.JobID, err)
+			continue
+		}
+
+		dk, err := db.newDataKey()
+		if err != nil {
+			return last, count, err
+		}
+		sealed, err := sealJSON(dk, raw)
+		if err != nil {
+			return last, count, err
+		}
+		newKeyID, dataKey := dataKeyColumns(dk)
+
+		// skip rows updated since they were read, they already use a new key
+		_, err = db.DB.Exec(
+			"UPDATE callbacks set event = $1, key_id = $2, data_key = $3 where id = $4 AND key_id IS NOT DISTINCT FROM $5",
+			json.RawMessage(sealed), newKeyID, dataKey, row.ID, row.KeyID,
+		)
+		if err != nil {
+			return last, count, err
+		}
+		count++
+	}
+
+	return last, count, nil
+}
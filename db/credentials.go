@@ -0,0 +1,209 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/cbelsole/dsw/encryption"
+	"github.com/cbelsole/dsw/types"
+	"github.com/lib/pq"
+)
+
+type credential struct {
+	TenantID     string         `db:"tenant_id"`
+	Name         string         `db:"name"`
+	TokenURL     string         `db:"token_url"`
+	ClientID     string         `db:"client_id"`
+	ClientSecret string         `db:"client_secret"`
+	Scopes       pq.StringArray `db:"scopes"`
+	KeyID        *string        `db:"key_id"`
+	DataKey      []byte         `db:"data_key"`
+	CreatedAt    time.Time      `db:"created_at"`
+	UpdatedAt    time.Time      `db:"updated_at"`
+}
+
+// toDBCredential converts a credential to a row, encrypting its secret with dk
+// unless it is nil
+func toDBCredential(c *types.Credential, dk *encryption.DataKey) (*credential, error) {
+	secret, err := sealString(dk, c.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, dataKey := dataKeyColumns(dk)
+
+	return &credential{
+		TenantID:     c.TenantID,
+		Name:         c.Name,
+		TokenURL:     c.TokenURL,
+		ClientID:     c.ClientID,
+		ClientSecret: secret,
+		Scopes:       pq.StringArray(c.Scopes),
+		KeyID:        keyID,
+		DataKey:      dataKey,
+		CreatedAt:    c.CreatedAt,
+		UpdatedAt:    c.UpdatedAt,
+	}, nil
+}
+
+// toCredential converts a row to a credential, decrypting its secret with dk
+// unless it is nil
+func (c *credential) toCredential(dk *encryption.DataKey) (*types.Credential, error) {
+	secret, err := openString(dk, c.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Credential{
+		TenantID:     c.TenantID,
+		Name:         c.Name,
+		TokenURL:     c.TokenURL,
+		ClientID:     c.ClientID,
+		ClientSecret: secret,
+		Scopes:       []string(c.Scopes),
+		CreatedAt:    c.CreatedAt,
+		UpdatedAt:    c.UpdatedAt,
+	}, nil
+}
+
+func (db *DB) encodeCredential(c *types.Credential) (*credential, error) {
+	dk, err := db.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return toDBCredential(c, dk)
+}
+
+func (db *DB) decodeCredential(c *credential) (*types.Credential, error) {
+	dk, err := db.openDataKey(c.KeyID, c.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toCredential(dk)
+}
+
+// SaveCredential creates or replaces a tenant's credential
+func (db *DB) SaveCredential(c *types.Credential) error {
+	c.UpdatedAt = time.Now()
+	dbCredential, err := db.encodeCredential(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.DB.NamedQuery(
+		`INSERT into credentials (tenant_id,name,token_url,client_id,client_secret,scopes,key_id,data_key) VALUES (:tenant_id,:name,:token_url,:client_id,:client_secret,:scopes,:key_id,:data_key)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET token_url = :token_url, client_id = :client_id, client_secret = :client_secret, scopes = :scopes, key_id = :key_id, data_key = :data_key, updated_at = :updated_at
+		RETURNING *`,
+		dbCredential,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.StructScan(dbCredential); err != nil {
+			return err
+		}
+	}
+	saved, err := db.decodeCredential(dbCredential)
+	if err != nil {
+		return err
+	}
+	*c = *saved
+
+	return nil
+}
+
+// GetCredential gets a tenant's credential by name. It returns nil if the
+// credential does not exist.
+func (db *DB) GetCredential(tenantID, name string) (*types.Credential, error) {
+	var c credential
+	if err := db.DB.Get(&c, "SELECT * from credentials where tenant_id = $1 AND name = $2", tenantID, name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return db.decodeCredential(&c)
+}
+
+// GetCredentials gets all of a tenant's credentials
+func (db *DB) GetCredentials(tenantID string) ([]*types.Credential, error) {
+	var dbCredentials []*credential
+	if err := db.DB.Select(&dbCredentials, "SELECT * from credentials where tenant_id = $1 ORDER BY name", tenantID); err != nil {
+		return nil, err
+	}
+
+	credentials := make([]*types.Credential, 0, len(dbCredentials))
+	for _, c := range dbCredentials {
+		credential, err := db.decodeCredential(c)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, nil
+}
+
+// CredentialKey identifies a credential
+type CredentialKey struct {
+	TenantID string
+	Name     string
+}
+
+// ReencryptCredentials re-encrypts up to limit credentials after after, in
+// tenant and name order, that are in plain text or encrypted under an old key
+// with the current key. It returns the key of the last credential read, nil
+// once there are none left, and the number of credentials re-encrypted.
+// Credentials that cannot be decrypted are logged and skipped.
+func (db *DB) ReencryptCredentials(after CredentialKey, limit int) (*CredentialKey, int, error) {
+	keyID := db.currentKeyID()
+	if keyID == nil {
+		return nil, 0, nil
+	}
+
+	var dbCredentials []*credential
+	if err := db.DB.Select(
+		&dbCredentials,
+		"SELECT * from credentials where key_id IS DISTINCT FROM $1 AND (tenant_id, name) > ($2, $3) ORDER BY tenant_id, name LIMIT $4",
+		*keyID, after.TenantID, after.Name, limit,
+	); err != nil {
+		return nil, 0, err
+	}
+	if len(dbCredentials) == 0 {
+		return nil, 0, nil
+	}
+	last := &CredentialKey{TenantID: dbCredentials[len(dbCredentials)-1].TenantID, Name: dbCredentials[len(dbCredentials)-1].Name}
+
+	count := 0
+	for _, dbCredential := range dbCredentials {
+		c, err := db.decodeCredential(dbCredential)
+		if err != nil {
+			log.Printf("skipping re-encryption of credential %s of tenant %s: %s\n", dbCredential.Name, dbCredential.TenantID, err)
+			continue
+		}
+
+		reencrypted, err := db.encodeCredential(c)
+		if err != nil {
+			return last, count, err
+		}
+
+		// skip rows updated since they were read, they already use a new key
+		_, err = db.DB.Exec(
+			"UPDATE credentials set client_secret = $1, key_id = $2, data_key = $3 where tenant_id = $4 AND name = $5 AND key_id IS NOT DISTINCT FROM $6",
+			reencrypted.ClientSecret, reencrypted.KeyID, reencrypted.DataKey, dbCredential.TenantID, dbCredential.Name, dbCredential.KeyID,
+		)
+		if err != nil {
+			return last, count, err
+		}
+		count++
+	}
+
+	return last, count, nil
+}
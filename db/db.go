@@ -2,164 +2,816 @@ package db
 
 import (
 	"database/sql"
+	"errors"
+	"log"
+	"strings"
 	"time"
 
+	"github.com/cbelsole/dsw/encryption"
 	"github.com/cbelsole/dsw/types"
 	"github.com/helloeave/json"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	uuid "github.com/satori/go.uuid"
 )
 
+// errors returned when a job cannot be cancelled
+var (
+	ErrJobNotFound = errors.New("job does not exist")
+	ErrJobFinished = errors.New("job has already finished")
+	ErrJobInFlight = errors.New("job is being delivered")
+)
+
+// ErrLeaseLost is returned when a processor saves a job whose lease it no
+// longer holds
+var ErrLeaseLost = errors.New("job is no longer leased to this processor")
+
+// ErrDuplicateJob is returned when a job is created with the dedupe key of a
+// pending or waiting job
+var ErrDuplicateJob = errors.New("a pending job has the same dedupe_key")
+
+// uniqueViolation is the postgres error code of a unique index violation
+const uniqueViolation = "23505"
+
 type (
 	DB struct {
 		DB *sqlx.DB
+		// Envelope encrypts payloads, errors and secrets at rest. Rows are
+		// stored in plain text when it is nil.
+		Envelope *encryption.Envelope
 	}
 	job struct {
-		ID        uuid.UUID       `db:"id"`
-		Errors    json.RawMessage `db:"errors"`
-		ErrorURI  *string         `db:"error_uri"`
-		ExecuteAt time.Time       `db:"execute_at"`
-		Payload   json.RawMessage `db:"payload"`
-		Sent      bool            `db:"sent"`
-		Try       int             `db:"try"`
-		URI       string          `db:"uri"`
-		CreatedAt time.Time       `db:"created_at"`
-		UpdatedAt time.Time       `db:"updated_at"`
+		ID               uuid.UUID       `db:"id"`
+		TenantID         string          `db:"tenant_id"`
+		CallbackEvents   pq.StringArray  `db:"callback_events"`
+		CallbackURI      *string         `db:"callback_uri"`
+		ConnectTimeoutMS *int64          `db:"connect_timeout_ms"`
+		Credential       *string         `db:"credential"`
+		DedupeKey        *string         `db:"dedupe_key"`
+		DelayMS          *int64          `db:"delay_ms"`
+		DependsOn        pq.StringArray  `db:"depends_on"`
+		Errors           json.RawMessage `db:"errors"`
+		ErrorURI         *string         `db:"error_uri"`
+		ExecuteAt        time.Time       `db:"execute_at"`
+		ExpiresAt        *time.Time      `db:"expires_at"`
+		MaxLatenessMS    *int64          `db:"max_lateness_ms"`
+		MaxRetries       int             `db:"max_retries"`
+		NextAttemptAt    *time.Time      `db:"next_attempt_at"`
+		ParentFields     json.RawMessage `db:"parent_fields"`
+		Payload          json.RawMessage `db:"payload"`
+		Priority         int             `db:"priority"`
+		Queue            string          `db:"queue"`
+		RateLimitGroup   *string         `db:"rate_limit_group"`
+		Response         *string         `db:"response"`
+		RunOn            string          `db:"run_on"`
+		Sent             bool            `db:"sent"`
+		Status           string          `db:"status"`
+		SuccessCriteria  *string         `db:"success_criteria"`
+		TimeoutMS        *int64          `db:"timeout_ms"`
+		TLSTimeoutMS     *int64          `db:"tls_timeout_ms"`
+		Try              int             `db:"try"`
+		URI              string          `db:"uri"`
+		LockedBy         *string         `db:"locked_by"`
+		LockedUntil      *time.Time      `db:"locked_until"`
+		KeyID            *string         `db:"key_id"`
+		DataKey          []byte          `db:"data_key"`
+		CreatedAt        time.Time       `db:"created_at"`
+		UpdatedAt        time.Time       `db:"updated_at"`
 	}
 )
 
-func toDBJob(j *types.Job) (*job, error) {
+// toDBJob converts a job to a row, encrypting its payload and errors with dk
+// unless it is nil
+func toDBJob(j *types.Job, dk *encryption.DataKey) (*job, error) {
 	errors, err := json.MarshalSafeCollections(j.Errors)
 	if err != nil {
 		return nil, err
 	}
+	if errors, err = sealJSON(dk, errors); err != nil {
+		return nil, err
+	}
 
 	payload, err := json.MarshalSafeCollections(j.Payload)
 	if err != nil {
 		return nil, err
 	}
+	if payload, err = sealJSON(dk, payload); err != nil {
+		return nil, err
+	}
+
+	keyID, dataKey := dataKeyColumns(dk)
+
+	parentFields, err := json.MarshalSafeCollections(j.ParentFields)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response is sealed like the payload since its body may be sensitive
+	var response *string
+	if j.Response != nil {
+		b, err := json.Marshal(j.Response)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = sealJSON(dk, b); err != nil {
+			return nil, err
+		}
+		sealed := string(b)
+		response = &sealed
+	}
+
+	var successCriteria *string
+	if j.SuccessCriteria != nil {
+		b, err := json.Marshal(j.SuccessCriteria)
+		if err != nil {
+			return nil, err
+		}
+		criteria := string(b)
+		successCriteria = &criteria
+	}
+
+	callbackEvents := append(pq.StringArray{}, j.CallbackEvents...)
+
+	dependsOn := make(pq.StringArray, 0, len(j.DependsOn))
+	for _, id := range j.DependsOn {
+		dependsOn = append(dependsOn, id.String())
+	}
 
 	return &job{
-		ID:        j.ID,
-		Errors:    json.RawMessage(errors),
-		ErrorURI:  j.ErrorURI,
-		ExecuteAt: j.ExecuteAt,
-		Payload:   json.RawMessage(payload),
-		Sent:      j.Sent,
-		Try:       j.Try,
-		URI:       j.URI,
-		CreatedAt: j.CreatedAt,
-		UpdatedAt: j.UpdatedAt,
+		ID:               j.ID,
+		TenantID:         j.TenantID,
+		CallbackEvents:   callbackEvents,
+		CallbackURI:      j.CallbackURI,
+		ConnectTimeoutMS: toMS(j.ConnectTimeout),
+		Credential:       j.Credential,
+		DedupeKey:        j.DedupeKey,
+		DelayMS:          toMS(j.Delay),
+		DependsOn:        dependsOn,
+		Errors:           json.RawMessage(errors),
+		ErrorURI:         j.ErrorURI,
+		ExecuteAt:        j.ExecuteAt,
+		ExpiresAt:        j.ExpiresAt,
+		MaxLatenessMS:    toMS(j.MaxLateness),
+		MaxRetries:       j.MaxRetries,
+		NextAttemptAt:    j.NextAttemptAt,
+		ParentFields:     json.RawMessage(parentFields),
+		Payload:          json.RawMessage(payload),
+		Priority:         j.Priority,
+		Queue:            j.Queue,
+		RateLimitGroup:   j.RateLimitGroup,
+		Response:         response,
+		RunOn:            j.RunOn,
+		Sent:             j.Sent,
+		Status:           j.Status,
+		SuccessCriteria:  successCriteria,
+		TimeoutMS:        toMS(j.Timeout),
+		TLSTimeoutMS:     toMS(j.TLSTimeout),
+		Try:              j.Try,
+		URI:              j.URI,
+		KeyID:            keyID,
+		DataKey:          dataKey,
+		CreatedAt:        j.CreatedAt,
+		UpdatedAt:        j.UpdatedAt,
 	}, nil
 }
 
-func (j *job) toJob() (*types.Job, error) {
+// toJob converts a row to a job, decrypting its payload and errors with dk
+// unless it is nil
+func (j *job) toJob(dk *encryption.DataKey) (*types.Job, error) {
+	rawErrors, err := openJSON(dk, j.Errors)
+	if err != nil {
+		return nil, err
+	}
+
 	var errors []string
-	if err := json.Unmarshal(j.Errors, &errors); err != nil {
+	if err := json.Unmarshal(rawErrors, &errors); err != nil {
+		return nil, err
+	}
+
+	rawPayload, err := openJSON(dk, j.Payload)
+	if err != nil {
 		return nil, err
 	}
 
 	var payload map[string]interface{}
-	if err := json.Unmarshal(j.Payload, &payload); err != nil {
+	if err := json.Unmarshal(rawPayload, &payload); err != nil {
 		return nil, err
 	}
 
+	var parentFields map[string]string
+	if err := json.Unmarshal(j.ParentFields, &parentFields); err != nil {
+		return nil, err
+	}
+
+	var response *types.Response
+	if j.Response != nil {
+		raw, err := openJSON(dk, json.RawMessage(*j.Response))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &response); err != nil {
+			return nil, err
+		}
+	}
+
+	var successCriteria *types.SuccessCriteria
+	if j.SuccessCriteria != nil {
+		if err := json.Unmarshal([]byte(*j.SuccessCriteria), &successCriteria); err != nil {
+			return nil, err
+		}
+	}
+
+	dependsOn := make([]uuid.UUID, 0, len(j.DependsOn))
+	for _, id := range j.DependsOn {
+		parsed, err := uuid.FromString(id)
+		if err != nil {
+			return nil, err
+		}
+		dependsOn = append(dependsOn, parsed)
+	}
+
 	return &types.Job{
-		ID:        j.ID,
-		Errors:    errors,
-		ErrorURI:  j.ErrorURI,
-		ExecuteAt: j.ExecuteAt,
-		Payload:   payload,
-		Sent:      j.Sent,
-		Try:       j.Try,
-		URI:       j.URI,
-		CreatedAt: j.CreatedAt,
-		UpdatedAt: j.UpdatedAt,
+		ID:              j.ID,
+		TenantID:        j.TenantID,
+		CallbackEvents:  []string(j.CallbackEvents),
+		CallbackURI:     j.CallbackURI,
+		ConnectTimeout:  fromMS(j.ConnectTimeoutMS),
+		Credential:      j.Credential,
+		DedupeKey:       j.DedupeKey,
+		Delay:           fromMS(j.DelayMS),
+		DependsOn:       dependsOn,
+		Errors:          errors,
+		ErrorURI:        j.ErrorURI,
+		ExecuteAt:       j.ExecuteAt,
+		ExpiresAt:       j.ExpiresAt,
+		MaxLateness:     fromMS(j.MaxLatenessMS),
+		MaxRetries:      j.MaxRetries,
+		NextAttemptAt:   j.NextAttemptAt,
+		ParentFields:    parentFields,
+		Payload:         payload,
+		Priority:        j.Priority,
+		Queue:           j.Queue,
+		RateLimitGroup:  j.RateLimitGroup,
+		Response:        response,
+		RunOn:           j.RunOn,
+		Sent:            j.Sent,
+		Status:          j.Status,
+		SuccessCriteria: successCriteria,
+		Timeout:         fromMS(j.TimeoutMS),
+		TLSTimeout:      fromMS(j.TLSTimeoutMS),
+		Try:             j.Try,
+		URI:             j.URI,
+		CreatedAt:       j.CreatedAt,
+		UpdatedAt:       j.UpdatedAt,
 	}, nil
 }
 
+// toMS converts a duration to the milliseconds it is stored as
+func toMS(d *types.Duration) *int64 {
+	if d == nil {
+		return nil
+	}
+
+	ms := int64(d.Duration / time.Millisecond)
+	return &ms
+}
+
+// fromMS converts stored milliseconds to a duration
+func fromMS(ms *int64) *types.Duration {
+	if ms == nil {
+		return nil
+	}
+
+	return &types.Duration{Duration: time.Duration(*ms) * time.Millisecond}
+}
+
 func NewDB(d *sql.DB) *DB {
 	return &DB{DB: sqlx.NewDb(d, "postgres")}
 }
 
+// encodeJob converts a job to a row encrypted with a new data key
+func (db *DB) encodeJob(j *types.Job) (*job, error) {
+	dk, err := db.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return toDBJob(j, dk)
+}
+
+// decodeJob converts a row to a job with the row's data key
+func (db *DB) decodeJob(j *job) (*types.Job, error) {
+	dk, err := db.openDataKey(j.KeyID, j.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return j.toJob(dk)
+}
+
+func (db *DB) decodeJobs(dbJobs []*job) ([]*types.Job, error) {
+	jobs := make([]*types.Job, 0, len(dbJobs))
+
+	for _, dbJob := range dbJobs {
+		job, err := db.decodeJob(dbJob)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
 // Ping is a tiny method to make sure the db is alive
 func (db *DB) Ping() error {
 	_, err := db.DB.Exec("SELECT 1")
 	return err
 }
 
-// CreateJob is a tiny method to make sure the db is alive
-func (db *DB) CreateJob(job *types.Job) error {
-	dbJob, err := toDBJob(job)
+// CreateJob creates a job and the jobs created with it in a transaction unless
+// the tenant has reached its pending job quota. When
+// a pending or waiting job has its dedupe key the job's DedupeMode decides
+// whether it is rejected, set to that job, or replaces that job's payload and
+// times. CreateJob reports whether a new job was created.
+func (db *DB) CreateJob(job *types.Job) (bool, error) {
+	requested := *job
+	created, err := db.tryCreateJob(job)
+
+	// a job created with the same dedupe key by a concurrent request cannot
+	// be seen until it commits. It has by the time the insert fails, so
+	// trying again ignores or replaces it.
+	if isDedupeViolation(err) && (requested.DedupeMode == types.DedupeIgnore || requested.DedupeMode == types.DedupeReplace) {
+		*job = requested
+		created, err = db.tryCreateJob(job)
+	}
+	if isDedupeViolation(err) {
+		return false, ErrDuplicateJob
+	}
+
+	return created, err
+}
+
+func (db *DB) tryCreateJob(job *types.Job) (bool, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+
+	created, err := db.dedupeJob(tx, job)
+	if err == nil && created {
+		// the jobs that run after this one are created waiting with it
+		if err = checkPendingJobQuota(tx, job.TenantID, jobTreeSize(job)); err == nil {
+			err = db.createJob(tx, job)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return created, tx.Commit()
+}
+
+// isDedupeViolation reports whether err is caused by another pending or
+// waiting job with the same dedupe key
+func isDedupeViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == uniqueViolation && pqErr.Constraint == "jobs_dedupe_key_idx"
+}
+
+// dedupeJob handles a pending or waiting job with the dedupe key of a new job.
+// It reports whether the new job still has to be created.
+func (db *DB) dedupeJob(tx *sqlx.Tx, j *types.Job) (bool, error) {
+	if j.DedupeKey == nil {
+		return true, nil
+	}
+
+	var dbJob job
+	if err := tx.Get(&dbJob, "SELECT * from jobs where tenant_id = $1 AND dedupe_key = $2 AND status IN ('pending', 'waiting') FOR UPDATE", j.TenantID, *j.DedupeKey); err != nil {
+		if err == sql.ErrNoRows {
+			return true, nil
+		}
+		return false, err
+	}
+
+	existing, err := db.decodeJob(&dbJob)
+	if err != nil {
+		return false, err
+	}
+
+	switch j.DedupeMode {
+	case types.DedupeIgnore:
+	case types.DedupeReplace:
+		if dbJob.LockedUntil != nil && dbJob.LockedUntil.After(time.Now()) {
+			return false, ErrJobInFlight
+		}
+
+		// the replaced job starts its retries over
+		existing.Payload = j.Payload
+		existing.ExecuteAt = j.ExecuteAt
+		existing.ExpiresAt = j.ExpiresAt
+		existing.Delay = j.Delay
+		existing.MaxLateness = j.MaxLateness
+		existing.NextAttemptAt = nil
+		existing.Try = 0
+		if err := db.updateJob(tx, existing); err != nil {
+			return false, err
+		}
+	default:
+		return false, ErrDuplicateJob
+	}
+
+	*j = *existing
+	return false, nil
+}
+
+// createJob inserts a job, waiting for the jobs it depends on that have not
+// finished, and then the jobs that run after it
+func (db *DB) createJob(tx *sqlx.Tx, job *types.Job) error {
+	status, waitingOn, err := dependencyStatus(tx, job)
 	if err != nil {
 		return err
 	}
+	job.Status = status
 
-	rows, err := db.DB.NamedQuery(
-		"INSERT into jobs (uri,error_uri,payload,execute_at) VALUES (:uri,:error_uri,:payload,:execute_at) RETURNING *",
+	dbJob, err := db.encodeJob(job)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := tx.BindNamed(
+		"INSERT into jobs (tenant_id,credential,dedupe_key,uri,callback_uri,callback_events,error_uri,payload,execute_at,expires_at,delay_ms,max_lateness_ms,max_retries,timeout_ms,connect_timeout_ms,tls_timeout_ms,rate_limit_group,priority,queue,status,depends_on,run_on,parent_fields,success_criteria,key_id,data_key) VALUES (:tenant_id,:credential,:dedupe_key,:uri,:callback_uri,:callback_events,:error_uri,:payload,:execute_at,:expires_at,:delay_ms,:max_lateness_ms,:max_retries,:timeout_ms,:connect_timeout_ms,:tls_timeout_ms,:rate_limit_group,:priority,:queue,:status,:depends_on,:run_on,:parent_fields,:success_criteria,:key_id,:data_key) RETURNING *",
 		dbJob,
 	)
-
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
-	if rows.Next() {
-		rows.StructScan(dbJob)
+	if err := tx.Get(dbJob, query, args...); err != nil {
+		return err
 	}
-	j, err := dbJob.toJob()
+
+	j, err := db.decodeJob(dbJob)
+	if err != nil {
+		return err
+	}
+	j.OnSuccess, j.OnFailure = job.OnSuccess, job.OnFailure
 	*job = *j
 
+	if err := logEvent(tx, types.EventCreated, job); err != nil {
+		return err
+	}
+
+	for _, id := range waitingOn {
+		if _, err := tx.Exec("INSERT into job_dependencies (job_id,depends_on_id) VALUES ($1,$2)", job.ID, id); err != nil {
+			return err
+		}
+	}
+
+	if job.OnSuccess != nil {
+		if err := db.createChild(tx, job, job.OnSuccess, types.RunOnSuccess); err != nil {
+			return err
+		}
+	}
+
+	if job.OnFailure != nil {
+		if err := db.createChild(tx, job, job.OnFailure, types.RunOnFailure); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (db *DB) UpdateJob(job *types.Job) error {
+// UpdateJob saves a job leased to owner. Jobs waiting for it are released or
+// skipped and the event for its callback URI is queued in the same
+// transaction. It returns ErrLeaseLost if the lease expired and the job was
+// claimed or changed since, and is meant for the processor only.
+func (db *DB) UpdateJob(job *types.Job, owner string) error {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var id uuid.UUID
+	if err := tx.Get(&id, "SELECT id from jobs where id = $1 AND locked_by = $2 FOR UPDATE", job.ID, owner); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return ErrLeaseLost
+		}
+		return err
+	}
+
+	if err := db.updateJob(tx, job); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := db.finishJob(tx, job); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelJob cancels one of a tenant's jobs that has not finished and is not
+// being delivered. The jobs waiting for it are skipped.
+func (db *DB) CancelJob(tenantID string, id uuid.UUID) (*types.Job, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := db.cancelJob(tx, tenantID, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return job, tx.Commit()
+}
+
+func (db *DB) cancelJob(tx *sqlx.Tx, tenantID string, id uuid.UUID) (*types.Job, error) {
+	var dbJob job
+	if err := tx.Get(&dbJob, "SELECT * from jobs where id = $1 AND tenant_id = $2 FOR UPDATE", id, tenantID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+
+	job, err := db.decodeJob(&dbJob)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Finished() {
+		return nil, ErrJobFinished
+	}
+	if dbJob.LockedUntil != nil && dbJob.LockedUntil.After(time.Now()) {
+		return nil, ErrJobInFlight
+	}
+
+	// a cancelled job no longer waits for the jobs it depends on
+	if _, err := tx.Exec("DELETE from job_dependencies where job_id = $1", id); err != nil {
+		return nil, err
+	}
+
+	job.Status = types.StatusCancelled
+	if err := db.updateJob(tx, job); err != nil {
+		return nil, err
+	}
+
+	return job, db.finishJob(tx, job)
+}
+
+// ExpireJob marks a pending job that is not leased expired. It reports whether
+// the job was expired and is meant for the processor only. The job's
+// expires_at is checked again since the processor's copy may be stale, e.g.
+// after the job was replaced by a job with the same dedupe key.
+func (db *DB) ExpireJob(j *types.Job) (bool, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+
+	var dbJob job
+	if err := tx.Get(
+		&dbJob,
+		"SELECT * from jobs where id = $1 AND status = 'pending' AND (locked_until IS NULL OR locked_until < now()) AND expires_at IS NOT NULL AND expires_at < now() FOR UPDATE",
+		j.ID,
+	); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	expired, err := db.decodeJob(&dbJob)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	expired.Expire()
+	if err := db.updateJob(tx, expired); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if err := db.finishJob(tx, expired); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	*j = *expired
+	return true, nil
+}
+
+// finishJob logs the event for a saved job, queues it for the job's callback
+// URI and releases or skips the jobs waiting for the job once it finished
+func (db *DB) finishJob(tx *sqlx.Tx, job *types.Job) error {
+	if event := job.Event(); event != "" {
+		if err := logEvent(tx, event, job); err != nil {
+			return err
+		}
+		if err := db.createCallback(tx, job, event); err != nil {
+			return err
+		}
+	}
+
+	if job.Finished() {
+		return db.releaseDependents(tx, job)
+	}
+
+	return nil
+}
+
+func (db *DB) updateJob(tx *sqlx.Tx, job *types.Job) error {
 	job.UpdatedAt = time.Now()
-	dbJob, err := toDBJob(job)
+	dbJob, err := db.encodeJob(job)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.DB.NamedExec("UPDATE jobs set errors = :errors, sent = :sent, try = :try, updated_at = :updated_at where id = :id", dbJob)
+	// the payload is rewritten with the errors and the response since they are
+	// sealed with the row's new data key. Saving a job releases its lease.
+	_, err = tx.NamedExec("UPDATE jobs set errors = :errors, payload = :payload, key_id = :key_id, data_key = :data_key, response = :response, sent = :sent, status = :status, try = :try, execute_at = :execute_at, expires_at = :expires_at, delay_ms = :delay_ms, max_lateness_ms = :max_lateness_ms, next_attempt_at = :next_attempt_at, locked_by = NULL, locked_until = NULL, updated_at = :updated_at where id = :id AND tenant_id = :tenant_id", dbJob)
 	return err
 }
 
-func (db *DB) GetJobs() ([]*types.Job, error) {
+// GetJobs gets all of a tenant's jobs
+func (db *DB) GetJobs(tenantID string) ([]*types.Job, error) {
 	var dbJobs []*job
-	if err := db.DB.Select(&dbJobs, "SELECT * from jobs"); err != nil {
+	if err := db.DB.Select(&dbJobs, "SELECT * from jobs where tenant_id = $1", tenantID); err != nil {
 		return nil, err
 	}
 
-	jobs := make([]*types.Job, 0, len(dbJobs))
+	return db.decodeJobs(dbJobs)
+}
 
-	for _, dbJob := range dbJobs {
-		job, err := dbJob.toJob()
-		if err != nil {
-			return nil, err
+// GetJob gets one of a tenant's jobs or nil if it does not exist
+func (db *DB) GetJob(tenantID string, id uuid.UUID) (*types.Job, error) {
+	var dbJob job
+	if err := db.DB.Get(&dbJob, "SELECT * from jobs where id = $1 AND tenant_id = $2", id, tenantID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-		jobs = append(jobs, job)
+		return nil, err
 	}
 
-	return jobs, nil
+	return db.decodeJob(&dbJob)
+}
+
+// CountPendingJobsByQueue counts the pending jobs in every queue
+func (db *DB) CountPendingJobsByQueue() (map[string]int, error) {
+	var rows []struct {
+		Queue string `db:"queue"`
+		Count int    `db:"count"`
+	}
+	if err := db.DB.Select(&rows, "SELECT queue, count(*) from jobs where status = 'pending' GROUP BY queue"); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Queue] = row.Count
+	}
+
+	return counts, nil
 }
 
-// GetPendingJobs gets jobs where try > -1 and try < 4 and sent is false
-func (db *DB) GetPendingJobs() ([]*types.Job, error) {
+// GetPendingJob gets a job by id if it is still pending and not leased and nil
+// otherwise. It is meant for the processor only.
+func (db *DB) GetPendingJob(id uuid.UUID) (*types.Job, error) {
+	var dbJob job
+	if err := db.DB.Get(&dbJob, "SELECT * from jobs where id = $1 AND status = 'pending' AND (locked_until IS NULL OR locked_until < now())", id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return db.decodeJob(&dbJob)
+}
+
+// GetPendingJobs gets up to limit pending jobs that are due before a time
+// and not leased for every tenant, ordered by when they are due. Jobs in
+// skipQueues or to hosts matching skipHosts are left out. Host patterns match
+// a host exactly or, when prefixed with "*.", any subdomain. It is meant for
+// the processor only.
+func (db *DB) GetPendingJobs(before time.Time, limit int, skipQueues, skipHosts []string) ([]*types.Job, error) {
+	hosts, suffixes := []string{}, []string{}
+	for _, pattern := range skipHosts {
+		if strings.HasPrefix(pattern, "*.") {
+			suffixes = append(suffixes, strings.ToLower(pattern[1:]))
+		} else {
+			hosts = append(hosts, strings.ToLower(pattern))
+		}
+	}
+
+	// the host is extracted from the uri like url.URL.Hostname does
 	var dbJobs []*job
-	if err := db.DB.Select(&dbJobs, "SELECT * from jobs where try > -1 AND try < 3 AND sent is false"); err != nil {
+	if err := db.DB.Select(
+		&dbJobs,
+		`SELECT * from jobs where status = 'pending' AND COALESCE(next_attempt_at, execute_at) <= $1 AND (locked_until IS NULL OR locked_until < now()) AND NOT (queue = ANY($3)) AND NOT EXISTS (SELECT 1 from (SELECT lower(btrim(substring(uri from '^[^:/?#]+://(?:[^/?#@]*@)?(\[[^]]*\]|[^:/?#]*)'), '[]')) AS host) h where h.host = ANY($4) OR EXISTS (SELECT 1 from unnest($5::text[]) suffix where right(h.host, length(suffix)) = suffix)) ORDER BY COALESCE(next_attempt_at, execute_at) LIMIT $2`,
+		before, limit, pq.Array(skipQueues), pq.Array(hosts), pq.Array(suffixes),
+	); err != nil {
 		return nil, err
 	}
 
-	jobs := make([]*types.Job, 0, len(dbJobs))
+	return db.decodeJobs(dbJobs)
+}
+
+// ClaimJob leases a pending job to an owner for ttl unless another owner holds
+// an unexpired lease and logs that it was dispatched. It reports whether the
+// job was claimed and is meant for the processor only.
+func (db *DB) ClaimJob(id uuid.UUID, owner string, ttl time.Duration) (bool, error) {
+	res, err := db.DB.Exec(
+		"WITH claimed AS (UPDATE jobs set locked_by = $1, locked_until = now() + $2 * interval '1 millisecond' where id = $3 AND status = 'pending' AND (locked_until IS NULL OR locked_until < now() OR locked_by = $1) RETURNING id, tenant_id, queue, status, try) INSERT into job_events (type,job_id,tenant_id,queue,status,try) SELECT $4, id, tenant_id, queue, status, try from claimed",
+		owner, int64(ttl/time.Millisecond), id, types.EventDispatched,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := res.RowsAffected()
+	return claimed == 1, err
+}
 
+// RenewLease extends an owner's lease on a pending job by ttl. It reports
+// whether the owner still held the lease and is meant for the processor only.
+func (db *DB) RenewLease(id uuid.UUID, owner string, ttl time.Duration) (bool, error) {
+	res, err := db.DB.Exec(
+		"UPDATE jobs set locked_until = now() + $1 * interval '1 millisecond' where id = $2 AND status = 'pending' AND locked_by = $3",
+		int64(ttl/time.Millisecond), id, owner,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	renewed, err := res.RowsAffected()
+	return renewed == 1, err
+}
+
+// ReleaseJob gives up an owner's lease on a job. It is meant for the
+// processor only.
+func (db *DB) ReleaseJob(id uuid.UUID, owner string) error {
+	_, err := db.DB.Exec("UPDATE jobs set locked_by = NULL, locked_until = NULL where id = $1 AND locked_by = $2", id, owner)
+	return err
+}
+
+// ReencryptJobs re-encrypts up to limit jobs with ids after after that are
+// in plain text or encrypted under an old key with the current key. It returns
+// the id of the last job read, uuid.Nil once there are none left, and the
+// number of jobs re-encrypted. Jobs that cannot be decrypted are logged and
+// skipped so that they do not hold up the rest.
+func (db *DB) ReencryptJobs(after uuid.UUID, limit int) (uuid.UUID, int, error) {
+	keyID := db.currentKeyID()
+	if keyID == nil {
+		return uuid.Nil, 0, nil
+	}
+
+	var dbJobs []*job
+	if err := db.DB.Select(&dbJobs, "SELECT * from jobs where key_id IS DISTINCT FROM $1 AND id > $2 ORDER BY id LIMIT $3", *keyID, after, limit); err != nil {
+		return uuid.Nil, 0, err
+	}
+	if len(dbJobs) == 0 {
+		return uuid.Nil, 0, nil
+	}
+	last := dbJobs[len(dbJobs)-1].ID
+
+	count := 0
 	for _, dbJob := range dbJobs {
-		job, err := dbJob.toJob()
+		j, err := db.decodeJob(dbJob)
 		if err != nil {
-			return nil, err
+			log.Printf("skipping re-encryption of job %s: %s\n", dbJob.ID, err)
+			continue
 		}
-		jobs = append(jobs, job)
+
+		reencrypted, err := db.encodeJob(j)
+		if err != nil {
+			return last, count, err
+		}
+
+		// skip rows updated since they were read, they already use a new key.
+		// Everything sealed with the row's data key is rewritten.
+		_, err = db.DB.Exec(
+			"UPDATE jobs set errors = $1, payload = $2, response = $3, key_id = $4, data_key = $5 where id = $6 AND key_id IS NOT DISTINCT FROM $7",
+			reencrypted.Errors, reencrypted.Payload, reencrypted.Response, reencrypted.KeyID, reencrypted.DataKey, dbJob.ID, dbJob.KeyID,
+		)
+		if err != nil {
+			return last, count, err
+		}
+		count++
 	}
 
-	return jobs, nil
+	return last, count, nil
 }
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ErrDependencyNotFound is returned when a job depends on a job that does not
+// exist or belongs to another tenant
+var ErrDependencyNotFound = errors.New("a job in depends_on does not exist")
+
+// dependencyStatus returns the status a new job starts in and the jobs it
+// has to wait for. The jobs it depends on are locked until the transaction
+// ends so that they cannot finish without seeing it.
+func dependencyStatus(tx *sqlx.Tx, job *types.Job) (string, []uuid.UUID, error) {
+	if len(job.DependsOn) == 0 {
+		return types.StatusPending, nil, nil
+	}
+
+	ids := pq.StringArray{}
+	seen := map[uuid.UUID]bool{}
+	for _, id := range job.DependsOn {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id.String())
+		}
+	}
+
+	var parents []struct {
+		ID     uuid.UUID `db:"id"`
+		Status string    `db:"status"`
+	}
+	if err := tx.Select(&parents, "SELECT id, status from jobs where id = ANY($1) AND tenant_id = $2 FOR UPDATE", ids, job.TenantID); err != nil {
+		return "", nil, err
+	}
+	if len(parents) != len(ids) {
+		return "", nil, ErrDependencyNotFound
+	}
+
+	var waitingOn []uuid.UUID
+	for _, parent := range parents {
+		if parent.Status == types.StatusPending || parent.Status == types.StatusWaiting {
+			waitingOn = append(waitingOn, parent.ID)
+			continue
+		}
+
+		if !job.Runs(parent.Status) {
+			job.Errors = append(job.Errors, fmt.Sprintf("job %s %s", parent.ID, parent.Status))
+			return types.StatusSkipped, nil, nil
+		}
+	}
+
+	if len(waitingOn) > 0 {
+		return types.StatusWaiting, waitingOn, nil
+	}
+
+	return types.StatusPending, nil, nil
+}
+
+// createChild creates a job that runs once parent succeeds or fails
+func (db *DB) createChild(tx *sqlx.Tx, parent, child *types.Job, runOn string) error {
+	child.TenantID = parent.TenantID
+	child.DependsOn = []uuid.UUID{parent.ID}
+	child.RunOn = runOn
+
+	return db.createJob(tx, child)
+}
+
+// releaseDependents updates the jobs waiting for a finished job. Jobs that
+// run after it copy their parent fields from its response and become pending
+// once they wait for nothing else. The others are skipped, along with the
+// jobs waiting for them.
+func (db *DB) releaseDependents(tx *sqlx.Tx, parent *types.Job) error {
+	var ids []uuid.UUID
+	if err := tx.Select(&ids, "DELETE from job_dependencies where depends_on_id = $1 RETURNING job_id", parent.ID); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var dbJob job
+		if err := tx.Get(&dbJob, "SELECT * from jobs where id = $1 FOR UPDATE", id); err != nil {
+			return err
+		}
+
+		child, err := db.decodeJob(&dbJob)
+		if err != nil {
+			return err
+		}
+
+		if child.Status != types.StatusWaiting {
+			continue
+		}
+
+		if !child.Runs(parent.Status) {
+			child.Status = types.StatusSkipped
+			child.Errors = append(child.Errors, fmt.Sprintf("job %s %s", parent.ID, parent.Status))
+			if err := db.updateJob(tx, child); err != nil {
+				return err
+			}
+			if err := db.releaseDependents(tx, child); err != nil {
+				return err
+			}
+			continue
+		}
+
+		child.CopyParentFields(parent)
+
+		var waiting int
+		if err := tx.Get(&waiting, "SELECT count(*) from job_dependencies where job_id = $1", id); err != nil {
+			return err
+		}
+		if waiting == 0 {
+			child.Release(time.Now())
+		}
+
+		if err := db.updateJob(tx, child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jobTreeSize returns the number of jobs created with a job, itself included
+func jobTreeSize(job *types.Job) int {
+	if job == nil {
+		return 0
+	}
+
+	return 1 + jobTreeSize(job.OnSuccess) + jobTreeSize(job.OnFailure)
+}
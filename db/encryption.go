@@ -0,0 +1,107 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/cbelsole/dsw/encryption"
+	"github.com/helloeave/json"
+)
+
+// newDataKey returns a data key for a new row or nil if encryption is not
+// configured
+func (db *DB) newDataKey() (*encryption.DataKey, error) {
+	if db.Envelope == nil {
+		return nil, nil
+	}
+
+	return db.Envelope.NewDataKey()
+}
+
+// openDataKey unwraps a row's data key. Rows without a key id are plain text.
+func (db *DB) openDataKey(keyID *string, wrapped []byte) (*encryption.DataKey, error) {
+	if keyID == nil {
+		return nil, nil
+	}
+
+	if db.Envelope == nil {
+		return nil, errors.New("row is encrypted but no key provider is configured")
+	}
+
+	return db.Envelope.OpenDataKey(*keyID, wrapped)
+}
+
+// currentKeyID returns the id of the key new rows are encrypted under
+func (db *DB) currentKeyID() *string {
+	if db.Envelope == nil {
+		return nil
+	}
+
+	keyID := db.Envelope.KeyID()
+	return &keyID
+}
+
+// dataKeyColumns returns the key id and wrapped data key columns for a row
+func dataKeyColumns(dk *encryption.DataKey) (*string, []byte) {
+	if dk == nil {
+		return nil, nil
+	}
+
+	return &dk.KeyID, dk.Wrapped
+}
+
+// sealJSON encrypts a json column into a json string so that the column keeps
+// its type
+func sealJSON(dk *encryption.DataKey, raw json.RawMessage) (json.RawMessage, error) {
+	if dk == nil {
+		return raw, nil
+	}
+
+	sealed, err := sealString(dk, string(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(sealed)
+}
+
+func openJSON(dk *encryption.DataKey, raw json.RawMessage) (json.RawMessage, error) {
+	if dk == nil {
+		return raw, nil
+	}
+
+	var sealed string
+	if err := json.Unmarshal(raw, &sealed); err != nil {
+		return nil, err
+	}
+
+	opened, err := openString(dk, sealed)
+	return json.RawMessage(opened), err
+}
+
+func sealString(dk *encryption.DataKey, s string) (string, error) {
+	if dk == nil {
+		return s, nil
+	}
+
+	ciphertext, err := dk.Encrypt([]byte(s))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func openString(dk *encryption.DataKey, s string) (string, error) {
+	if dk == nil {
+		return s, nil
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := dk.Decrypt(ciphertext)
+	return string(plaintext), err
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+)
+
+type jobEvent struct {
+	ID        int64     `db:"id"`
+	Type      string    `db:"type"`
+	JobID     uuid.UUID `db:"job_id"`
+	TenantID  string    `db:"tenant_id"`
+	Queue     string    `db:"queue"`
+	Status    string    `db:"status"`
+	Try       int       `db:"try"`
+	TxID      int64     `db:"txid"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// JobEventFilter selects the events of a job or a queue. Zero values match
+// every job and queue.
+type JobEventFilter struct {
+	JobID *uuid.UUID
+	Queue string
+}
+
+// logEvent appends an event for the job's current state to the job event log
+func logEvent(tx *sqlx.Tx, eventType string, job *types.Job) error {
+	_, err := tx.Exec(
+		"INSERT into job_events (type,job_id,tenant_id,queue,status,try) VALUES ($1,$2,$3,$4,$5,$6)",
+		eventType, job.ID, job.TenantID, job.Queue, job.Status, job.Try,
+	)
+	return err
+}
+
+// GetJobEvents gets up to limit of a tenant's events logged after the event
+// with id after, oldest first. IDs are taken before the events commit so
+// events are ordered by the transaction that logged them and only returned
+// once every transaction that started before theirs has finished. That way no
+// event can commit behind one that was already returned.
+func (db *DB) GetJobEvents(tenantID string, filter JobEventFilter, after int64, limit int) ([]*types.JobEvent, error) {
+	var rows []*jobEvent
+	if err := db.DB.Select(
+		&rows,
+		"SELECT * from job_events where tenant_id = $1 AND (txid, id) > (COALESCE((SELECT txid from job_events where id = $2), 0), $2) AND txid < txid_snapshot_xmin(txid_current_snapshot()) AND ($3::uuid IS NULL OR job_id = $3) AND ($4 = '' OR queue = $4) ORDER BY txid, id LIMIT $5",
+		tenantID, after, filter.JobID, filter.Queue, limit,
+	); err != nil {
+		return nil, err
+	}
+
+	events := make([]*types.JobEvent, 0, len(rows))
+	for _, e := range rows {
+		events = append(events, &types.JobEvent{
+			ID:        e.ID,
+			Type:      e.Type,
+			JobID:     e.JobID,
+			TenantID:  e.TenantID,
+			Queue:     e.Queue,
+			Status:    e.Status,
+			Try:       e.Try,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+
+	return events, nil
+}
+
+// LastJobEventID gets the id of the last of a tenant's events GetJobEvents
+// would return or 0 if there is none
+func (db *DB) LastJobEventID(tenantID string) (int64, error) {
+	var id int64
+	err := db.DB.Get(&id, "SELECT COALESCE((SELECT id from job_events where tenant_id = $1 AND txid < txid_snapshot_xmin(txid_current_snapshot()) ORDER BY txid DESC, id DESC LIMIT 1), 0)", tenantID)
+	return id, err
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+type pause struct {
+	Scope     string    `db:"scope"`
+	Target    string    `db:"target"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// SavePause pauses a scope and sets when it was paused. Pausing a paused scope
+// keeps the original time.
+func (db *DB) SavePause(p *types.Pause) error {
+	return db.DB.Get(
+		&p.CreatedAt,
+		"INSERT into pauses (scope,target) VALUES ($1,$2) ON CONFLICT (scope,target) DO UPDATE SET scope = EXCLUDED.scope RETURNING created_at",
+		p.Scope, p.Target,
+	)
+}
+
+// DeletePause resumes a scope and reports whether it was paused
+func (db *DB) DeletePause(scope, target string) (bool, error) {
+	res, err := db.DB.Exec("DELETE from pauses where scope = $1 AND target = $2", scope, target)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+	return deleted == 1, err
+}
+
+// GetPauses gets every paused scope
+func (db *DB) GetPauses() ([]*types.Pause, error) {
+	var rows []*pause
+	if err := db.DB.Select(&rows, "SELECT * from pauses ORDER BY created_at"); err != nil {
+		return nil, err
+	}
+
+	pauses := make([]*types.Pause, 0, len(rows))
+	for _, p := range rows {
+		pauses = append(pauses, &types.Pause{Scope: p.Scope, Target: p.Target, CreatedAt: p.CreatedAt})
+	}
+
+	return pauses, nil
+}
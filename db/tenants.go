@@ -0,0 +1,100 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrPendingJobQuota is returned when a tenant has as many pending jobs as its
+// max_pending_jobs allows
+var ErrPendingJobQuota = errors.New("tenant has reached its limit of pending jobs")
+
+type tenant struct {
+	ID             string    `db:"id"`
+	MaxPendingJobs *int      `db:"max_pending_jobs"`
+	DeliveryRate   *float64  `db:"delivery_rate"`
+	MaxRetries     *int      `db:"max_retries"`
+	SigningSecret  *string   `db:"signing_secret"`
+	APIKeyHash     *string   `db:"api_key_hash"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+func (t *tenant) toTenant() *types.Tenant {
+	return &types.Tenant{
+		ID:             t.ID,
+		MaxPendingJobs: t.MaxPendingJobs,
+		DeliveryRate:   t.DeliveryRate,
+		MaxRetries:     t.MaxRetries,
+		SigningSecret:  t.SigningSecret,
+	}
+}
+
+// GetTenant gets a tenant's quotas and defaults. Tenants without a row get no
+// quotas and the processor defaults.
+func (db *DB) GetTenant(id string) (*types.Tenant, error) {
+	var t tenant
+	if err := db.DB.Get(&t, "SELECT * from tenants where id = $1", id); err != nil {
+		if err == sql.ErrNoRows {
+			return &types.Tenant{ID: id}, nil
+		}
+		return nil, err
+	}
+
+	return t.toTenant(), nil
+}
+
+// GetTenantByAPIKey gets the tenant an API key belongs to or nil if it belongs
+// to none. Keys are looked up by their SHA-256 hash so that they are neither
+// stored nor compared in plain text.
+func (db *DB) GetTenantByAPIKey(key string) (*types.Tenant, error) {
+	sum := sha256.Sum256([]byte(key))
+
+	var t tenant
+	if err := db.DB.Get(&t, "SELECT * from tenants where api_key_hash = $1", hex.EncodeToString(sum[:])); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return t.toTenant(), nil
+}
+
+// checkPendingJobQuota returns ErrPendingJobQuota if creating count more jobs
+// would take a tenant over its max_pending_jobs. The tenant's row stays locked
+// until the transaction ends so that concurrent creates count each other's
+// jobs.
+func checkPendingJobQuota(tx *sqlx.Tx, tenantID string, count int) error {
+	var maxPendingJobs *int
+	if err := tx.Get(&maxPendingJobs, "SELECT max_pending_jobs from tenants where id = $1", tenantID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if maxPendingJobs == nil {
+		return nil
+	}
+
+	if _, err := tx.Exec("SELECT 1 from tenants where id = $1 FOR UPDATE", tenantID); err != nil {
+		return err
+	}
+
+	var pending int
+	if err := tx.Get(&pending, "SELECT count(*) from jobs where tenant_id = $1 AND status IN ('pending', 'waiting')", tenantID); err != nil {
+		return err
+	}
+
+	if pending+count > *maxPendingJobs {
+		return ErrPendingJobQuota
+	}
+
+	return nil
+}
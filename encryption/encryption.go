@@ -0,0 +1,120 @@
+// Package encryption implements envelope encryption. Every record is
+// encrypted with its own data key which is in turn wrapped by a key
+// encryption key held by a KeyProvider.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// KeyProvider wraps and unwraps data keys with key encryption keys. Local
+// keyfiles and KMS style services both implement it.
+type KeyProvider interface {
+	// KeyID returns the id of the key new data keys are wrapped with
+	KeyID() string
+	// WrapKey encrypts a data key with the key named by KeyID
+	WrapKey(dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped by the key with the given id
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Envelope creates and opens data keys with a KeyProvider
+type Envelope struct {
+	Provider KeyProvider
+}
+
+// DataKey encrypts the fields of a single record
+type DataKey struct {
+	// KeyID is the id of the key encryption key that wrapped the data key
+	KeyID string
+	// Wrapped is the encrypted data key stored alongside the record
+	Wrapped []byte
+
+	aead cipher.AEAD
+}
+
+// NewEnvelope returns an Envelope for provider
+func NewEnvelope(provider KeyProvider) *Envelope {
+	return &Envelope{Provider: provider}
+}
+
+// KeyID returns the id of the key new records are encrypted under
+func (e *Envelope) KeyID() string {
+	return e.Provider.KeyID()
+}
+
+// NewDataKey generates and wraps a new data key
+func (e *Envelope) NewDataKey() (*DataKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := e.Provider.WrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{KeyID: e.Provider.KeyID(), Wrapped: wrapped, aead: aead}, nil
+}
+
+// OpenDataKey unwraps a stored data key
+func (e *Envelope) OpenDataKey(keyID string, wrapped []byte) (*DataKey, error) {
+	key, err := e.Provider.UnwrapKey(keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{KeyID: keyID, Wrapped: wrapped, aead: aead}, nil
+}
+
+// Encrypt seals plaintext and prefixes it with a random nonce
+func (k *DataKey) Encrypt(plaintext []byte) ([]byte, error) {
+	return seal(k.aead, plaintext)
+}
+
+// Decrypt opens ciphertext produced by Encrypt
+func (k *DataKey) Decrypt(ciphertext []byte) ([]byte, error) {
+	return open(k.aead, ciphertext)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
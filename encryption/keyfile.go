@@ -0,0 +1,81 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// keyfile is the format of a local keyfile. Keys are base64 encoded 32 byte
+// AES keys.
+//
+//	{"current": "2018-10", "keys": {"2018-09": "...", "2018-10": "..."}}
+type keyfile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LocalKeyProvider wraps data keys with AES keys read from a local keyfile.
+// It is meant for development; production deployments should use a KMS.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewLocalKeyProvider reads a keyfile. Rotate keys by adding a new key and
+// making it current; old keys must be kept until every record is re-encrypted.
+func NewLocalKeyProvider(filename string) (*LocalKeyProvider, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var kf keyfile
+	if err := json.NewDecoder(f).Decode(&kf); err != nil {
+		return nil, err
+	}
+
+	p := &LocalKeyProvider{current: kf.Current, keys: map[string]cipher.AEAD{}}
+	for id, encoded := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes", id)
+		}
+
+		if p.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := p.keys[kf.Current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the keyfile", kf.Current)
+	}
+
+	return p, nil
+}
+
+// KeyID implements KeyProvider
+func (p *LocalKeyProvider) KeyID() string {
+	return p.current
+}
+
+// WrapKey implements KeyProvider
+func (p *LocalKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return seal(p.keys[p.current], dataKey)
+}
+
+// UnwrapKey implements KeyProvider
+func (p *LocalKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+
+	return open(aead, wrapped)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// Admin exposes the processor's state to operators
+type Admin interface {
+	CircuitBreakers() []types.CircuitBreaker
+	QueueStats() ([]types.Queue, error)
+	Pause(p *types.Pause) error
+	Resume(p *types.Pause) (bool, error)
+	Pauses() ([]*types.Pause, error)
+}
+
+type pauseRequest struct {
+	Scope  string `json:"scope"`
+	Target string `json:"target"`
+}
+
+// ListCircuitBreakers returns the state of every target host's circuit breaker
+func (h *Handler) ListCircuitBreakers(w http.ResponseWriter, r *http.Request) {
+	writeHTTPResponse(w, http.StatusOK, h.Admin.CircuitBreakers())
+}
+
+// ListQueues returns every queue with its depth and in flight count
+func (h *Handler) ListQueues(w http.ResponseWriter, r *http.Request) {
+	queues, err := h.Admin.QueueStats()
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, queues)
+}
+
+// ListPauses returns every paused scope
+func (h *Handler) ListPauses(w http.ResponseWriter, r *http.Request) {
+	pauses, err := h.Admin.Pauses()
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, pauses)
+}
+
+// Pause takes a pauseRequest and stops delivering every job, a queue's jobs or
+// the jobs to hosts matching a pattern until it is resumed
+func (h *Handler) Pause(w http.ResponseWriter, r *http.Request) {
+	pause, err := h.decodePause(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.Admin.Pause(pause); err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, pause)
+}
+
+// Resume takes a pauseRequest and resumes the paused scope
+func (h *Handler) Resume(w http.ResponseWriter, r *http.Request) {
+	pause, err := h.decodePause(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resumed, err := h.Admin.Resume(pause)
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !resumed {
+		writeHTTPError(w, http.StatusNotFound, fmt.Errorf("%s %s is not paused", pause.Scope, pause.Target))
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, pause)
+}
+
+// decodePause decodes and validates a pauseRequest. Host patterns are
+// lowercased and every scope but all needs a target.
+func (h *Handler) decodePause(r *http.Request) (*types.Pause, error) {
+	decoder := json.NewDecoder(r.Body)
+	var req pauseRequest
+	if err := decoder.Decode(&req); err != nil {
+		return nil, err
+	}
+
+	switch req.Scope {
+	case types.PauseAll:
+		req.Target = ""
+	case types.PauseQueue:
+		if err := h.Scheduler.CheckQueue(req.Target); err != nil {
+			return nil, err
+		}
+	case types.PauseHost:
+		if req.Target == "" {
+			return nil, errors.New("target must be a host pattern")
+		}
+		req.Target = strings.ToLower(req.Target)
+	default:
+		return nil, fmt.Errorf("scope must be %s, %s or %s", types.PauseAll, types.PauseQueue, types.PauseHost)
+	}
+
+	return &types.Pause{Scope: req.Scope, Target: req.Target}, nil
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+type saveCredentialRequest struct {
+	Name         string   `json:"name"`
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// SaveCredential takes a saveCredentialRequest and creates or replaces the
+// tenant's credential with the same name
+func (h *Handler) SaveCredential(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var req saveCredentialRequest
+	if err := decoder.Decode(&req); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Name == "" || req.ClientID == "" || req.ClientSecret == "" {
+		writeHTTPError(w, http.StatusBadRequest, errors.New("name, client_id and client_secret are required"))
+		return
+	}
+
+	// validate token URL
+	if _, err := url.ParseRequestURI(req.TokenURL); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.Scheduler.CheckURI(req.TokenURL); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	credential := types.Credential{
+		TenantID:     tenantFromRequest(r),
+		Name:         req.Name,
+		TokenURL:     req.TokenURL,
+		ClientID:     req.ClientID,
+		ClientSecret: req.ClientSecret,
+		Scopes:       req.Scopes,
+	}
+
+	if err := h.DB.SaveCredential(&credential); err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the cached token was issued for the old client id and secret
+	h.Scheduler.InvalidateCredential(credential.TenantID, credential.Name)
+
+	writeHTTPResponse(w, http.StatusCreated, &credential)
+}
+
+// ListCredentials returns a list of the tenant's credentials without their
+// secrets
+func (h *Handler) ListCredentials(w http.ResponseWriter, r *http.Request) {
+	credentials, err := h.DB.GetCredentials(tenantFromRequest(r))
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, credentials)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cbelsole/dsw/db"
+	"github.com/helloeave/json"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// eventPollInterval is how often the event log is polled for new events
+	eventPollInterval = time.Second
+	// eventBatchSize caps how many events are read from the log at once
+	eventBatchSize = 100
+	// eventKeepAlive is how often an idle stream is sent a comment so that
+	// proxies keep it open
+	eventKeepAlive = 15 * time.Second
+	// eventStreamDuration ends streams before the server's write timeout.
+	// Clients reconnect and resume from the Last-Event-ID they saw.
+	eventStreamDuration = 25 * time.Second
+)
+
+// StreamEvents streams the tenant's job events as server-sent events. Events
+// can be filtered by job_id and queue. The stream resumes after the
+// Last-Event-ID header or last_event_id parameter, or starts with new events.
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	var filter db.JobEventFilter
+	if jobID := r.URL.Query().Get("job_id"); jobID != "" {
+		id, err := uuid.FromString(jobID)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		filter.JobID = &id
+	}
+	filter.Queue = r.URL.Query().Get("queue")
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var after int64
+	if lastEventID != "" {
+		var err error
+		if after, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid last event id %q", lastEventID))
+			return
+		}
+	} else {
+		var err error
+		if after, err = h.DB.LastJobEventID(tenantFromRequest(r)); err != nil {
+			writeHTTPError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tenantID := tenantFromRequest(r)
+	end := time.After(eventStreamDuration)
+	lastWrite := time.Now()
+	for {
+		events, err := h.DB.GetJobEvents(tenantID, filter, after, eventBatchSize)
+		if err != nil {
+			// the client reconnects and resumes after the last event it got
+			log.Printf("error reading job events: %s\n", err)
+			return
+		}
+
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+			after = event.ID
+		}
+
+		if len(events) > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		if len(events) == eventBatchSize {
+			continue
+		}
+
+		if time.Since(lastWrite) >= eventKeepAlive {
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end:
+			return
+		case <-time.After(eventPollInterval):
+		}
+	}
+}
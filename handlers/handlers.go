@@ -2,26 +2,62 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/cbelsole/dsw/db"
-	"github.com/cbelsole/dsw/processors"
 	"github.com/cbelsole/dsw/types"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
 )
 
 type (
+	// Scheduler validates and enqueues jobs for delivery
+	Scheduler interface {
+		Enqueue(job *types.Job) (bool, error)
+		CheckURI(uri string) error
+		CheckRateLimitGroup(name string) error
+		CheckQueue(name string) error
+		InvalidateCredential(tenantID, name string)
+	}
 	Handler struct {
-		DB  *db.DB
-		Job processors.Job
+		DB        *db.DB
+		Scheduler Scheduler
+		Admin     Admin
+		// MaxPast and MaxFuture bound how far in the past or future jobs may
+		// be scheduled. Zero values are unbounded.
+		MaxPast, MaxFuture time.Duration
 	}
 	createJobRequest struct {
-		ErrorURI  *string                `json:"error_uri"`
-		ExecuteAt time.Time              `json:"execute_at"`
-		Payload   map[string]interface{} `json:"payload"`
-		URI       string                 `json:"uri"`
+		CallbackEvents  []string               `json:"callback_events"`
+		CallbackURI     *string                `json:"callback_uri"`
+		ConnectTimeout  *types.Duration        `json:"connect_timeout"`
+		Credential      *string                `json:"credential"`
+		DedupeKey       *string                `json:"dedupe_key"`
+		DedupeMode      string                 `json:"dedupe_mode"`
+		DependsOn       []uuid.UUID            `json:"depends_on"`
+		ErrorURI        *string                `json:"error_uri"`
+		Delay           *types.Duration        `json:"delay"`
+		ExecuteAt       string                 `json:"execute_at"`
+		ExpiresAt       string                 `json:"expires_at"`
+		MaxLateness     *types.Duration        `json:"max_lateness"`
+		OnFailure       *createJobRequest      `json:"on_failure"`
+		OnSuccess       *createJobRequest      `json:"on_success"`
+		ParentFields    map[string]string      `json:"parent_fields"`
+		Payload         map[string]interface{} `json:"payload"`
+		Priority        int                    `json:"priority"`
+		Queue           string                 `json:"queue"`
+		RateLimitGroup  *string                `json:"rate_limit_group"`
+		RunOn           string                 `json:"run_on"`
+		SuccessCriteria *types.SuccessCriteria `json:"success_criteria"`
+		Timeout         *types.Duration        `json:"timeout"`
+		TLSTimeout      *types.Duration        `json:"tls_timeout"`
+		Timezone        string                 `json:"timezone"`
+		URI             string                 `json:"uri"`
 	}
 )
 
@@ -44,49 +80,290 @@ func (h *Handler) CreateJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate URI
-	if _, err := url.ParseRequestURI(req.URI); err != nil {
+	tenantID := tenantFromRequest(r)
+	job, status, err := h.newJob(tenantID, &req)
+	if err != nil {
+		writeHTTPError(w, status, err)
+		return
+	}
+
+	tenant, err := h.DB.GetTenant(tenantID)
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if tenant.MaxRetries != nil {
+		setMaxRetries(job, *tenant.MaxRetries)
+	}
+
+	// add job to queue
+	created, err := h.Scheduler.Enqueue(job)
+	switch err {
+	case nil:
+	case db.ErrDependencyNotFound:
 		writeHTTPError(w, http.StatusBadRequest, err)
 		return
+	case db.ErrDuplicateJob, db.ErrJobInFlight:
+		writeHTTPError(w, http.StatusConflict, err)
+		return
+	case db.ErrPendingJobQuota:
+		writeHTTPError(w, http.StatusTooManyRequests, err)
+		return
+	default:
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// a deduplicated job is the pending job with the same dedupe key
+	if !created {
+		writeHTTPResponse(w, http.StatusOK, job)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusCreated, job)
+}
+
+// newJob validates a createJobRequest and the jobs that run after it and
+// builds the job. It returns the status to respond with when they are invalid.
+func (h *Handler) newJob(tenantID string, req *createJobRequest) (*types.Job, int, error) {
+	// validate URI
+	if _, err := url.ParseRequestURI(req.URI); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := h.Scheduler.CheckURI(req.URI); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	// validate callback URI if present
+	if req.CallbackURI != nil {
+		if _, err := url.ParseRequestURI(*req.CallbackURI); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		if err := h.Scheduler.CheckURI(*req.CallbackURI); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	// validate callback events if present
+	for _, event := range req.CallbackEvents {
+		if !validEvent(event) {
+			return nil, http.StatusBadRequest, fmt.Errorf("unknown callback event %s", event)
+		}
 	}
 
 	// validate error URI if present
 	if req.ErrorURI != nil {
 		if _, err := url.ParseRequestURI(*req.ErrorURI); err != nil {
-			writeHTTPError(w, http.StatusBadRequest, err)
-			return
+			return nil, http.StatusBadRequest, err
+		}
+
+		if err := h.Scheduler.CheckURI(*req.ErrorURI); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	executeAt, err := h.executeAt(req, time.Now())
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	expiresAt, err := expiresAt(req, executeAt)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	// validate timeouts if present
+	for _, timeout := range []struct {
+		name  string
+		value *types.Duration
+	}{{"timeout", req.Timeout}, {"connect_timeout", req.ConnectTimeout}, {"tls_timeout", req.TLSTimeout}} {
+		if timeout.value != nil && timeout.value.Duration <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("%s must be positive", timeout.name)
+		}
+	}
+
+	// validate queue if present
+	if req.Queue != "" {
+		if err := h.Scheduler.CheckQueue(req.Queue); err != nil {
+			return nil, http.StatusBadRequest, err
 		}
 	}
 
+	// validate rate limit group if present
+	if req.RateLimitGroup != nil {
+		if err := h.Scheduler.CheckRateLimitGroup(*req.RateLimitGroup); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	// validate dedupe mode if present
+	switch req.DedupeMode {
+	case "", types.DedupeReject, types.DedupeIgnore, types.DedupeReplace:
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("dedupe_mode must be %s, %s or %s", types.DedupeReject, types.DedupeIgnore, types.DedupeReplace)
+	}
+	if req.DedupeMode != "" && req.DedupeKey == nil {
+		return nil, http.StatusBadRequest, errors.New("dedupe_mode requires dedupe_key")
+	}
+
+	// validate run on if present
+	if req.RunOn != "" && req.RunOn != types.RunOnSuccess && req.RunOn != types.RunOnFailure {
+		return nil, http.StatusBadRequest, fmt.Errorf("run_on must be %s or %s", types.RunOnSuccess, types.RunOnFailure)
+	}
+
+	// validate success criteria if present
+	if err := req.SuccessCriteria.Validate(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
 	// validate payload
 	if _, err := json.Marshal(req.Payload); err != nil {
-		writeHTTPError(w, http.StatusBadRequest, err)
+		return nil, http.StatusBadRequest, err
+	}
+
+	// validate credential if present
+	if req.Credential != nil {
+		credential, err := h.DB.GetCredential(tenantID, *req.Credential)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		if credential == nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("credential %s does not exist", *req.Credential)
+		}
+	}
+
+	job := &types.Job{
+		TenantID:        tenantID,
+		CallbackEvents:  req.CallbackEvents,
+		CallbackURI:     req.CallbackURI,
+		ConnectTimeout:  req.ConnectTimeout,
+		Credential:      req.Credential,
+		DedupeKey:       req.DedupeKey,
+		DedupeMode:      req.DedupeMode,
+		Delay:           req.Delay,
+		DependsOn:       req.DependsOn,
+		ErrorURI:        req.ErrorURI,
+		ExecuteAt:       executeAt,
+		ExpiresAt:       expiresAt,
+		MaxLateness:     req.MaxLateness,
+		ParentFields:    req.ParentFields,
+		Payload:         req.Payload,
+		Priority:        req.Priority,
+		Queue:           req.Queue,
+		RateLimitGroup:  req.RateLimitGroup,
+		RunOn:           req.RunOn,
+		SuccessCriteria: req.SuccessCriteria,
+		Timeout:         req.Timeout,
+		TLSTimeout:      req.TLSTimeout,
+		URI:             req.URI,
+	}
+
+	// validate the jobs that run after this one. They are created with it,
+	// never on their own, so there is nothing to dedupe them against
+	for _, child := range []*createJobRequest{req.OnSuccess, req.OnFailure} {
+		if child != nil && (child.DedupeKey != nil || child.DedupeMode != "") {
+			return nil, http.StatusBadRequest, errors.New("on_success and on_failure jobs cannot set dedupe_key or dedupe_mode")
+		}
+	}
+
+	if req.OnSuccess != nil {
+		child, status, err := h.newJob(tenantID, req.OnSuccess)
+		if err != nil {
+			return nil, status, fmt.Errorf("on_success: %s", err)
+		}
+		job.OnSuccess = child
+	}
+
+	if req.OnFailure != nil {
+		child, status, err := h.newJob(tenantID, req.OnFailure)
+		if err != nil {
+			return nil, status, fmt.Errorf("on_failure: %s", err)
+		}
+		job.OnFailure = child
+	}
+
+	return job, http.StatusCreated, nil
+}
+
+// setMaxRetries sets the max retries of a job and the jobs created with it
+func setMaxRetries(job *types.Job, maxRetries int) {
+	job.MaxRetries = maxRetries
+
+	for _, child := range []*types.Job{job.OnSuccess, job.OnFailure} {
+		if child != nil {
+			setMaxRetries(child, maxRetries)
+		}
+	}
+}
+
+// ListJobs returns a list of all the tenant's jobs
+func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.DB.GetJobs(tenantFromRequest(r))
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	job := types.Job{
-		ErrorURI:  req.ErrorURI,
-		ExecuteAt: req.ExecuteAt,
-		Payload:   req.Payload,
-		URI:       req.URI,
+	writeHTTPResponse(w, http.StatusOK, jobs)
+}
+
+// GetJob returns one of the tenant's jobs with its last response
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
 	}
 
-	// add job to queue
-	if err := h.Job.Enqueue(&job); err != nil {
+	job, err := h.DB.GetJob(tenantFromRequest(r), id)
+	if err != nil {
 		writeHTTPError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if job == nil {
+		writeHTTPError(w, http.StatusNotFound, fmt.Errorf("job %s does not exist", id))
+		return
+	}
 
-	writeHTTPResponse(w, http.StatusCreated, &job)
+	writeHTTPResponse(w, http.StatusOK, job)
 }
 
-// ListJobs returns a list of all the jobs in the system
-func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
-	jobs, err := h.DB.GetJobs()
+// CancelJob cancels one of the tenant's jobs unless it has finished or is
+// being delivered
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
 	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	job, err := h.DB.CancelJob(tenantFromRequest(r), id)
+	switch err {
+	case nil:
+	case db.ErrJobNotFound:
+		writeHTTPError(w, http.StatusNotFound, err)
+		return
+	case db.ErrJobFinished, db.ErrJobInFlight:
+		writeHTTPError(w, http.StatusConflict, err)
+		return
+	default:
 		writeHTTPError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	writeHTTPResponse(w, http.StatusOK, jobs)
+	writeHTTPResponse(w, http.StatusOK, job)
+}
+
+func validEvent(event string) bool {
+	for _, e := range types.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
 }
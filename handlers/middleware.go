@@ -1,12 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/cbelsole/dsw/types"
 )
 
+type contextKey string
+
+const tenantKey contextKey = "tenant"
+
 // RecoveryMiddleware recovers from panics thrown in your handlers by sending a
 // 500 back with an error
 func RecoveryMiddleware(next http.Handler) http.Handler {
@@ -39,3 +48,56 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		log.Printf("URI: %s, Method: %s, Time: %s\n", r.RequestURI, r.Method, time.Since(start))
 	})
 }
+
+// TenantMiddleware authenticates the tenant by the API key in an
+// Authorization: Bearer header and stores it on the request context. Requests
+// without a valid key are unauthorized.
+func (h *Handler) TenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" || key == r.Header.Get("Authorization") {
+			writeHTTPError(w, http.StatusUnauthorized, errors.New("missing API key"))
+			return
+		}
+
+		tenant, err := h.DB.GetTenantByAPIKey(key)
+		if err != nil {
+			writeHTTPError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if tenant == nil {
+			writeHTTPError(w, http.StatusUnauthorized, errors.New("invalid API key"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey, tenant.ID)))
+	})
+}
+
+// AdminMiddleware only lets requests with an Authorization: Bearer header
+// matching token through. Every request is forbidden when token is empty.
+func AdminMiddleware(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				writeHTTPError(w, http.StatusForbidden, errors.New("admin routes are disabled"))
+				return
+			}
+
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				writeHTTPError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func tenantFromRequest(r *http.Request) string {
+	if tenantID, ok := r.Context().Value(tenantKey).(string); ok {
+		return tenantID
+	}
+
+	return types.DefaultTenant
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// wallClockLayout is the layout of an execute_at in a timezone
+const wallClockLayout = "2006-01-02T15:04:05"
+
+// executeAt returns when a job should run. A delay is relative to now. An
+// execute_at is RFC3339 or, with a timezone, a wall clock time in that IANA
+// timezone. Jobs without either run now.
+func (h *Handler) executeAt(req *createJobRequest, now time.Time) (time.Time, error) {
+	if req.Delay != nil && req.ExecuteAt != "" {
+		return time.Time{}, errors.New("delay and execute_at cannot both be set")
+	}
+	if req.Timezone != "" && req.ExecuteAt == "" && req.ExpiresAt == "" {
+		return time.Time{}, errors.New("timezone requires execute_at or expires_at")
+	}
+
+	var at time.Time
+	switch {
+	case req.Delay != nil:
+		if req.Delay.Duration < 0 {
+			return time.Time{}, errors.New("delay must not be negative")
+		}
+		at = now.Add(req.Delay.Duration)
+	case req.ExecuteAt != "":
+		var err error
+		if at, err = parseTime("execute_at", req.ExecuteAt, req.Timezone); err != nil {
+			return time.Time{}, err
+		}
+	default:
+		at = now
+	}
+
+	if h.MaxPast > 0 && at.Before(now.Add(-h.MaxPast)) {
+		return time.Time{}, fmt.Errorf("execute_at is more than %s in the past", h.MaxPast)
+	}
+	if h.MaxFuture > 0 && at.After(now.Add(h.MaxFuture)) {
+		return time.Time{}, fmt.Errorf("execute_at is more than %s in the future", h.MaxFuture)
+	}
+
+	return at.UTC(), nil
+}
+
+// expiresAt returns when a job that runs at executeAt expires or nil if it
+// never does. An expires_at is parsed like execute_at and a max_lateness is
+// relative to executeAt.
+func expiresAt(req *createJobRequest, executeAt time.Time) (*time.Time, error) {
+	if req.MaxLateness != nil && req.ExpiresAt != "" {
+		return nil, errors.New("max_lateness and expires_at cannot both be set")
+	}
+
+	var at time.Time
+	switch {
+	case req.MaxLateness != nil:
+		if req.MaxLateness.Duration <= 0 {
+			return nil, errors.New("max_lateness must be positive")
+		}
+		at = executeAt.Add(req.MaxLateness.Duration)
+	case req.ExpiresAt != "":
+		var err error
+		if at, err = parseTime("expires_at", req.ExpiresAt, req.Timezone); err != nil {
+			return nil, err
+		}
+		if !at.After(executeAt) {
+			return nil, errors.New("expires_at must be after execute_at")
+		}
+	default:
+		return nil, nil
+	}
+
+	at = at.UTC()
+	return &at, nil
+}
+
+// parseTime parses an RFC3339 time or, with a timezone, a wall clock time in
+// that IANA timezone
+func parseTime(name, value, timezone string) (time.Time, error) {
+	if timezone == "" {
+		at, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s must be an RFC3339 time or set a timezone: %s", name, err)
+		}
+		return at, nil
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timezone: %s", err)
+	}
+
+	at, err := time.ParseInLocation(wallClockLayout, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a local time like %s when timezone is set", name, wallClockLayout)
+	}
+
+	// wall clock times skipped by a DST change do not exist and are moved by
+	// ParseInLocation. UTC has no DST so parsing in it keeps the wall clock.
+	wall, err := time.ParseInLocation(wallClockLayout, value, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a local time like %s when timezone is set", name, wallClockLayout)
+	}
+	if at.Format(wallClockLayout) != wall.Format(wallClockLayout) {
+		return time.Time{}, fmt.Errorf("%s %s does not exist in %s", name, value, timezone)
+	}
+
+	// wall clock times repeated by a DST change happen twice and
+	// ParseInLocation may pick either, so use the earlier one
+	_, offset := at.Zone()
+	if _, before := at.Add(-12 * time.Hour).Zone(); before > offset {
+		earlier := at.Add(-time.Duration(before-offset) * time.Second)
+		if earlier.Format(wallClockLayout) == at.Format(wallClockLayout) {
+			return earlier, nil
+		}
+	}
+
+	return at, nil
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		timezone string
+		want     string
+		wantErr  bool
+	}{
+		{name: "RFC3339", value: "2018-10-01T09:00:00+02:00", want: "2018-10-01T07:00:00Z"},
+		{name: "RFC3339 without offset", value: "2018-10-01T09:00:00", wantErr: true},
+		{name: "summer time", value: "2018-07-01T09:00:00", timezone: "Europe/Berlin", want: "2018-07-01T07:00:00Z"},
+		{name: "winter time", value: "2018-12-01T09:00:00", timezone: "Europe/Berlin", want: "2018-12-01T08:00:00Z"},
+		{name: "one digit hour", value: "2018-10-01T9:00:00", timezone: "Europe/Berlin", want: "2018-10-01T07:00:00Z"},
+		{name: "one digit hour skipped by DST", value: "2018-03-25T2:30:00", timezone: "Europe/Berlin", wantErr: true},
+		{name: "fractional seconds", value: "2018-12-01T09:00:00.5", timezone: "Europe/Berlin", want: "2018-12-01T08:00:00.5Z"},
+		{name: "skipped by DST", value: "2018-03-25T02:30:00", timezone: "Europe/Berlin", wantErr: true},
+		{name: "skipped by DST in New York", value: "2018-03-11T02:00:00", timezone: "America/New_York", wantErr: true},
+		{name: "repeated by DST", value: "2018-10-28T02:30:00", timezone: "Europe/Berlin", want: "2018-10-28T00:30:00Z"},
+		{name: "offset with timezone", value: "2018-10-01T09:00:00+02:00", timezone: "Europe/Berlin", wantErr: true},
+		{name: "unknown timezone", value: "2018-10-01T09:00:00", timezone: "Nowhere/Else", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTime("execute_at", test.value, test.timezone)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseTime(%q, %q) = %s, want an error", test.name, test.value, test.timezone, got)
+			}
+			continue
+		}
+
+		want, _ := time.Parse(time.RFC3339Nano, test.want)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("%s: parseTime(%q, %q) = %s, %v, want %s", test.name, test.value, test.timezone, got, err, want)
+		}
+	}
+}
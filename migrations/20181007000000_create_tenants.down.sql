@@ -0,0 +1,6 @@
+DROP INDEX jobs_tenant_id_idx;
+
+ALTER TABLE jobs DROP COLUMN max_retries;
+ALTER TABLE jobs DROP COLUMN tenant_id;
+
+DROP TABLE tenants;
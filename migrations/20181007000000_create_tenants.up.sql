@@ -0,0 +1,14 @@
+CREATE TABLE tenants(
+   id TEXT PRIMARY KEY,
+   max_pending_jobs INTEGER,
+   delivery_rate DOUBLE PRECISION,
+   max_retries INTEGER,
+   signing_secret TEXT,
+   created_at timestamp DEFAULT now(),
+   updated_at timestamp DEFAULT now()
+);
+
+ALTER TABLE jobs ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN max_retries INTEGER NOT NULL DEFAULT 3;
+
+CREATE INDEX jobs_tenant_id_idx ON jobs (tenant_id);
@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN timeout_ms BIGINT;
@@ -0,0 +1,3 @@
+ALTER TABLE jobs DROP COLUMN credential;
+
+DROP TABLE credentials;
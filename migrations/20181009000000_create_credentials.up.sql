@@ -0,0 +1,13 @@
+CREATE TABLE credentials(
+   tenant_id TEXT NOT NULL,
+   name TEXT NOT NULL,
+   token_url TEXT NOT NULL,
+   client_id TEXT NOT NULL,
+   client_secret TEXT NOT NULL,
+   scopes TEXT[] NOT NULL DEFAULT '{}',
+   created_at timestamp DEFAULT now(),
+   updated_at timestamp DEFAULT now(),
+   PRIMARY KEY (tenant_id, name)
+);
+
+ALTER TABLE jobs ADD COLUMN credential TEXT;
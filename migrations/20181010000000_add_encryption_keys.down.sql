@@ -0,0 +1,5 @@
+ALTER TABLE credentials DROP COLUMN data_key;
+ALTER TABLE credentials DROP COLUMN key_id;
+
+ALTER TABLE jobs DROP COLUMN data_key;
+ALTER TABLE jobs DROP COLUMN key_id;
@@ -0,0 +1,5 @@
+ALTER TABLE jobs ADD COLUMN key_id TEXT;
+ALTER TABLE jobs ADD COLUMN data_key BYTEA;
+
+ALTER TABLE credentials ADD COLUMN key_id TEXT;
+ALTER TABLE credentials ADD COLUMN data_key BYTEA;
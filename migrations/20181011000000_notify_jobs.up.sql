@@ -0,0 +1,9 @@
+CREATE FUNCTION notify_jobs() RETURNS trigger AS $$
+BEGIN
+   PERFORM pg_notify('jobs', NEW.id::text);
+   RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER jobs_notify AFTER INSERT OR UPDATE ON jobs
+   FOR EACH ROW EXECUTE PROCEDURE notify_jobs();
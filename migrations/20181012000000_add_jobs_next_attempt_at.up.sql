@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN next_attempt_at timestamp;
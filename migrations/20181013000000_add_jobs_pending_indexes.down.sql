@@ -0,0 +1,2 @@
+DROP INDEX jobs_pending_tenant_id_idx;
+DROP INDEX jobs_pending_due_idx;
@@ -0,0 +1,7 @@
+-- the predicates match the pending job queries in db.go exactly so that the
+-- planner can use these partial indexes
+CREATE INDEX jobs_pending_due_idx ON jobs ((COALESCE(next_attempt_at, execute_at)))
+   WHERE try > -1 AND try < max_retries AND sent is false;
+
+CREATE INDEX jobs_pending_tenant_id_idx ON jobs (tenant_id)
+   WHERE try > -1 AND try < max_retries AND sent is false;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN locked_until;
+ALTER TABLE jobs DROP COLUMN locked_by;
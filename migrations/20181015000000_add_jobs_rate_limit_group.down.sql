@@ -0,0 +1 @@
+ALTER TABLE jobs DROP COLUMN rate_limit_group;
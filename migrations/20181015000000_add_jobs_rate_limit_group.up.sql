@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN rate_limit_group TEXT;
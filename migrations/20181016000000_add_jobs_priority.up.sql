@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN priority INT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN queue TEXT NOT NULL DEFAULT 'default';
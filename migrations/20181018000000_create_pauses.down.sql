@@ -0,0 +1,3 @@
+DROP TRIGGER pauses_notify ON pauses;
+DROP FUNCTION notify_pauses();
+DROP TABLE pauses;
@@ -0,0 +1,16 @@
+CREATE TABLE pauses(
+   scope TEXT NOT NULL,
+   target TEXT NOT NULL DEFAULT '',
+   created_at timestamp DEFAULT now(),
+   PRIMARY KEY (scope, target)
+);
+
+CREATE FUNCTION notify_pauses() RETURNS trigger AS $$
+BEGIN
+   PERFORM pg_notify('pauses', '');
+   RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER pauses_notify AFTER INSERT OR UPDATE OR DELETE ON pauses
+   FOR EACH STATEMENT EXECUTE PROCEDURE notify_pauses();
@@ -0,0 +1,15 @@
+DROP TABLE job_dependencies;
+
+DROP INDEX jobs_pending_due_idx;
+DROP INDEX jobs_pending_tenant_id_idx;
+
+CREATE INDEX jobs_pending_due_idx ON jobs ((COALESCE(next_attempt_at, execute_at)))
+   WHERE try > -1 AND try < max_retries AND sent is false;
+
+CREATE INDEX jobs_pending_tenant_id_idx ON jobs (tenant_id)
+   WHERE try > -1 AND try < max_retries AND sent is false;
+
+ALTER TABLE jobs DROP COLUMN parent_fields;
+ALTER TABLE jobs DROP COLUMN run_on;
+ALTER TABLE jobs DROP COLUMN depends_on;
+ALTER TABLE jobs DROP COLUMN status;
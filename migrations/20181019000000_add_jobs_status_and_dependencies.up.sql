@@ -0,0 +1,26 @@
+ALTER TABLE jobs ADD COLUMN status TEXT NOT NULL DEFAULT 'pending';
+UPDATE jobs SET status = 'succeeded' WHERE sent;
+UPDATE jobs SET status = 'failed' WHERE NOT sent AND (try = -1 OR try >= max_retries);
+
+ALTER TABLE jobs ADD COLUMN depends_on UUID[] NOT NULL DEFAULT '{}';
+ALTER TABLE jobs ADD COLUMN run_on TEXT NOT NULL DEFAULT 'success';
+ALTER TABLE jobs ADD COLUMN parent_fields json NOT NULL DEFAULT '{}'::jsonb;
+
+-- the pending job queries now filter by status
+DROP INDEX jobs_pending_due_idx;
+DROP INDEX jobs_pending_tenant_id_idx;
+
+CREATE INDEX jobs_pending_due_idx ON jobs ((COALESCE(next_attempt_at, execute_at)))
+   WHERE status = 'pending';
+
+CREATE INDEX jobs_pending_tenant_id_idx ON jobs (tenant_id)
+   WHERE status IN ('pending', 'waiting');
+
+-- the jobs a waiting job still waits for
+CREATE TABLE job_dependencies(
+   job_id UUID NOT NULL REFERENCES jobs(id),
+   depends_on_id UUID NOT NULL REFERENCES jobs(id),
+   PRIMARY KEY (job_id, depends_on_id)
+);
+
+CREATE INDEX job_dependencies_depends_on_id_idx ON job_dependencies (depends_on_id);
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN response;
+ALTER TABLE jobs DROP COLUMN callback_uri;
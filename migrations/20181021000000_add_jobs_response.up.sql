@@ -0,0 +1,2 @@
+ALTER TABLE jobs ADD COLUMN callback_uri TEXT;
+ALTER TABLE jobs ADD COLUMN response json;
@@ -0,0 +1,2 @@
+DROP TABLE callbacks;
+ALTER TABLE jobs DROP COLUMN callback_events;
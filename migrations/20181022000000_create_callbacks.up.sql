@@ -0,0 +1,17 @@
+ALTER TABLE jobs ADD COLUMN callback_events TEXT[] NOT NULL DEFAULT '{}';
+
+-- events waiting to be sent to callback URIs
+CREATE TABLE callbacks(
+   id UUID PRIMARY KEY,
+   tenant_id TEXT NOT NULL,
+   job_id UUID NOT NULL REFERENCES jobs(id),
+   uri TEXT NOT NULL,
+   event json NOT NULL,
+   try INTEGER NOT NULL DEFAULT 0,
+   next_attempt_at timestamp NOT NULL DEFAULT now(),
+   key_id TEXT,
+   data_key BYTEA,
+   created_at timestamp DEFAULT now()
+);
+
+CREATE INDEX callbacks_next_attempt_at_idx ON callbacks (next_attempt_at);
@@ -0,0 +1,13 @@
+-- the job event log streamed by GET /events
+CREATE TABLE job_events(
+   id BIGSERIAL PRIMARY KEY,
+   type TEXT NOT NULL,
+   job_id UUID NOT NULL REFERENCES jobs(id),
+   tenant_id TEXT NOT NULL,
+   queue TEXT NOT NULL,
+   status TEXT NOT NULL,
+   try INTEGER NOT NULL,
+   created_at timestamp DEFAULT now()
+);
+
+CREATE INDEX job_events_tenant_id_idx ON job_events (tenant_id, id);
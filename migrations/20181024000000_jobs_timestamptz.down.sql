@@ -0,0 +1,8 @@
+ALTER TABLE job_events ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE callbacks ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE callbacks ALTER COLUMN next_attempt_at TYPE timestamp USING next_attempt_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN updated_at TYPE timestamp USING updated_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN locked_until TYPE timestamp USING locked_until AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN next_attempt_at TYPE timestamp USING next_attempt_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN execute_at TYPE timestamp USING execute_at AT TIME ZONE 'UTC';
@@ -0,0 +1,9 @@
+-- times were stored in UTC without a zone
+ALTER TABLE jobs ALTER COLUMN execute_at TYPE timestamptz USING execute_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN next_attempt_at TYPE timestamptz USING next_attempt_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN locked_until TYPE timestamptz USING locked_until AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE jobs ALTER COLUMN updated_at TYPE timestamptz USING updated_at AT TIME ZONE 'UTC';
+ALTER TABLE callbacks ALTER COLUMN next_attempt_at TYPE timestamptz USING next_attempt_at AT TIME ZONE 'UTC';
+ALTER TABLE callbacks ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE job_events ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
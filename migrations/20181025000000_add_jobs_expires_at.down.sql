@@ -0,0 +1 @@
+ALTER TABLE jobs DROP COLUMN expires_at;
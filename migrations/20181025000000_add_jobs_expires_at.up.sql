@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN expires_at timestamptz;
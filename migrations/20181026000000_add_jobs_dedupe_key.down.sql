@@ -0,0 +1 @@
+ALTER TABLE jobs DROP COLUMN dedupe_key;
@@ -0,0 +1,5 @@
+ALTER TABLE jobs ADD COLUMN dedupe_key TEXT;
+
+-- at most one job per dedupe key is waiting to be sent
+CREATE UNIQUE INDEX jobs_dedupe_key_idx ON jobs (tenant_id, dedupe_key)
+   WHERE status IN ('pending', 'waiting');
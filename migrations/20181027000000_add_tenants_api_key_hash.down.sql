@@ -0,0 +1 @@
+ALTER TABLE tenants DROP COLUMN api_key_hash;
@@ -0,0 +1,2 @@
+-- the hex SHA-256 hash of the API key a tenant authenticates with
+ALTER TABLE tenants ADD COLUMN api_key_hash TEXT UNIQUE;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN tls_timeout_ms;
+ALTER TABLE jobs DROP COLUMN connect_timeout_ms;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs ADD COLUMN connect_timeout_ms BIGINT;
+ALTER TABLE jobs ADD COLUMN tls_timeout_ms BIGINT;
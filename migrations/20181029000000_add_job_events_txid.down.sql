@@ -0,0 +1,4 @@
+DROP INDEX job_events_tenant_id_txid_idx;
+CREATE INDEX job_events_tenant_id_idx ON job_events (tenant_id, id);
+
+ALTER TABLE job_events DROP COLUMN txid;
@@ -0,0 +1,6 @@
+-- events are streamed in the order of the transactions that logged them so
+-- that an event committed late is not skipped
+ALTER TABLE job_events ADD COLUMN txid BIGINT NOT NULL DEFAULT txid_current();
+
+DROP INDEX job_events_tenant_id_idx;
+CREATE INDEX job_events_tenant_id_txid_idx ON job_events (tenant_id, txid, id);
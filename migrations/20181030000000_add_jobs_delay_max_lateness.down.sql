@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN max_lateness_ms;
+ALTER TABLE jobs DROP COLUMN delay_ms;
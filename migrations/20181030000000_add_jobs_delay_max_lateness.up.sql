@@ -0,0 +1,2 @@
+ALTER TABLE jobs ADD COLUMN delay_ms BIGINT;
+ALTER TABLE jobs ADD COLUMN max_lateness_ms BIGINT;
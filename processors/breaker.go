@@ -0,0 +1,179 @@
+package processors
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+	uuid "github.com/satori/go.uuid"
+)
+
+// circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// breakerProbeInterval is how often jobs to a half open host check whether
+// the probe has closed the breaker
+const breakerProbeInterval = time.Second
+
+// BreakerConfig configures the circuit breaker guarding every target host
+type BreakerConfig struct {
+	// FailureThreshold is how many consecutive failed deliveries open a
+	// host's breaker. Defaults to 5, a negative threshold disables breakers.
+	FailureThreshold int `json:"failure_threshold"`
+	// Cooldown is how long an open breaker defers jobs before probing the
+	// host with a single job. Defaults to 30s.
+	Cooldown types.Duration `json:"cooldown"`
+}
+
+// breaker stops deliveries to a host after consecutive failures. Failed
+// deliveries are timeouts, connection errors and 5xx responses.
+type breaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probe is the job sent to test a half open host
+	probe uuid.UUID
+}
+
+// allow reports whether a job may be sent to the breaker's host and, if not,
+// when to check again
+func (b *breaker) allow(job *types.Job, cooldown time.Duration, now time.Time) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openedAt.Add(cooldown)) {
+			return false, b.openedAt.Add(cooldown)
+		}
+		b.state = breakerHalfOpen
+		b.probe = job.ID
+		return true, now
+	case breakerHalfOpen:
+		if b.probe != uuid.Nil && b.probe != job.ID {
+			return false, now.Add(breakerProbeInterval)
+		}
+		b.probe = job.ID
+		return true, now
+	default:
+		return true, now
+	}
+}
+
+// record counts the outcome of a delivery and reports whether it opened the
+// breaker
+func (b *breaker) record(job *types.Job, failed bool, threshold int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		b.probe = uuid.Nil
+		return false
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		// failures of jobs sent before the breaker opened do not count
+		if b.probe != job.ID {
+			return false
+		}
+		b.failures++
+	case breakerOpen:
+		return false
+	default:
+		b.failures++
+		if b.failures < threshold {
+			return false
+		}
+	}
+
+	b.state = breakerOpen
+	b.openedAt = now
+	b.probe = uuid.Nil
+	return true
+}
+
+// abandon lets another job probe the host when the probe is not sent
+func (b *breaker) abandon(job *types.Job) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.probe == job.ID {
+		b.probe = uuid.Nil
+	}
+}
+
+// breaker returns the breaker of a job's host or nil when breakers are
+// disabled
+func (j *Job) breaker(job *types.Job) *breaker {
+	if j.Client.Breaker.FailureThreshold < 0 {
+		return nil
+	}
+
+	v, _ := j.breakers.LoadOrStore(jobHost(job), &breaker{state: breakerClosed})
+	return v.(*breaker)
+}
+
+// allowHost reports whether a job may be sent to its host and, if not, when
+// to check again
+func (j *Job) allowHost(job *types.Job, now time.Time) (bool, time.Time) {
+	b := j.breaker(job)
+	if b == nil {
+		return true, now
+	}
+
+	return b.allow(job, j.Client.Breaker.Cooldown.Duration, now)
+}
+
+// recordDelivery updates the breaker of a job's host with a delivery's outcome
+func (j *Job) recordDelivery(job *types.Job, failed bool) {
+	b := j.breaker(job)
+	if b == nil {
+		return
+	}
+
+	if b.record(job, failed, j.Client.Breaker.FailureThreshold, time.Now()) {
+		breakersOpened.Add(j.Name, 1)
+		log.Printf("%s: circuit breaker for %s opened\n", j.Name, jobHost(job))
+	}
+}
+
+// abandonProbe lets another job probe the host of a job that will not be sent
+func (j *Job) abandonProbe(job *types.Job) {
+	if b := j.breaker(job); b != nil {
+		b.abandon(job)
+	}
+}
+
+// CircuitBreakers returns the state of every host's circuit breaker
+func (j *Job) CircuitBreakers() []types.CircuitBreaker {
+	breakers := []types.CircuitBreaker{}
+	j.breakers.Range(func(k, v interface{}) bool {
+		b := v.(*breaker)
+		b.mu.Lock()
+		cb := types.CircuitBreaker{Host: k.(string), State: b.state, Failures: b.failures}
+		if b.state != breakerClosed {
+			openedAt := b.openedAt
+			cb.OpenedAt = &openedAt
+		}
+		b.mu.Unlock()
+
+		breakers = append(breakers, cb)
+		return true
+	})
+
+	sort.Slice(breakers, func(a, b int) bool {
+		return breakers[a].Host < breakers[b].Host
+	})
+
+	return breakers
+}
@@ -0,0 +1,83 @@
+package processors
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// EventHeader carries the type of the event sent to a callback URI
+const EventHeader = "X-DSW-Event"
+
+// CallbackConfig configures how events are sent to callback URIs
+type CallbackConfig struct {
+	// PollInterval is how often events that are due are sent. Defaults to 5s.
+	PollInterval types.Duration `json:"poll_interval"`
+	// BatchSize caps how many events are sent at once. Defaults to 100.
+	BatchSize int `json:"batch_size"`
+	// MaxRetries is how often an event is sent before it is dropped. Defaults
+	// to 10.
+	MaxRetries int `json:"max_retries"`
+	// RetryBackoff is how long to wait before sending an event again. It
+	// doubles with every attempt. Defaults to 10s.
+	RetryBackoff types.Duration `json:"retry_backoff"`
+}
+
+// sendCallbacks sends the events that are due in batches until none are left.
+// Events are claimed for the lease TTL so an event may be sent more than once
+// if an instance stops while sending it.
+func (j *Job) sendCallbacks() {
+	for {
+		callbacks, err := j.DB.ClaimCallbacks(j.Client.Callbacks.BatchSize, j.LeaseTTL)
+		if err != nil {
+			log.Printf("error claiming callbacks: %s\n", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range callbacks {
+			wg.Add(1)
+			go func(c *types.Callback) {
+				defer wg.Done()
+				j.sendCallback(c)
+			}(c)
+		}
+		wg.Wait()
+
+		if len(callbacks) < j.Client.Callbacks.BatchSize {
+			return
+		}
+	}
+}
+
+// sendCallback posts an event to its callback URI and deletes it once it was
+// sent or retried MaxRetries times
+func (j *Job) sendCallback(c *types.Callback) {
+	body, err := json.Marshal(c.Event)
+	if err != nil {
+		log.Printf("error encoding event %s: %s\n", c.Event.ID, err)
+		return
+	}
+
+	err = j.post(c.TenantID, c.URI, body, http.Header{EventHeader: {c.Event.Type}})
+	if err == nil || c.Try+1 >= j.Client.Callbacks.MaxRetries {
+		if err != nil {
+			log.Printf("dropping event %s for job %s after %d attempts: %s\n", c.Event.ID, c.Event.JobID, c.Try+1, err)
+		}
+
+		if err := j.DB.DeleteCallback(c.Event.ID); err != nil {
+			log.Printf("error deleting event %s: %s\n", c.Event.ID, err)
+		}
+		return
+	}
+
+	log.Printf("error sending event %s for job %s: %s\n", c.Event.ID, c.Event.JobID, err)
+	nextAttemptAt := time.Now().Add(j.Client.Callbacks.RetryBackoff.Duration << uint(c.Try))
+	if err := j.DB.RetryCallback(c.Event.ID, nextAttemptAt); err != nil {
+		log.Printf("error retrying event %s: %s\n", c.Event.ID, err)
+	}
+}
@@ -0,0 +1,373 @@
+package processors
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// ClientConfig tunes the HTTP client jobs are delivered with. Zero values use
+// the defaults below.
+type ClientConfig struct {
+	// ConnectTimeout limits dialing a target unless the job sets its own.
+	// Defaults to 10s.
+	ConnectTimeout types.Duration `json:"connect_timeout"`
+	// TLSHandshakeTimeout limits the TLS handshake unless the job sets its
+	// own. Defaults to 10s.
+	TLSHandshakeTimeout types.Duration `json:"tls_handshake_timeout"`
+	// Timeout limits a whole delivery unless the job sets its own. Defaults to
+	// 30s.
+	Timeout types.Duration `json:"timeout"`
+	// IdleConnTimeout closes pooled connections idle for longer. Defaults to
+	// 90s.
+	IdleConnTimeout types.Duration `json:"idle_conn_timeout"`
+	// MaxIdleConns limits pooled connections across hosts. Defaults to 100.
+	MaxIdleConns int `json:"max_idle_conns"`
+	// MaxIdleConnsPerHost limits pooled connections per host. Defaults to 10.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	// MaxConnsPerHost limits connections per host. Defaults to unlimited.
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+	// FollowRedirects follows up to MaxRedirects redirects. Otherwise, and
+	// after MaxRedirects, the redirect response is classified like any other.
+	FollowRedirects bool `json:"follow_redirects"`
+	// MaxRedirects defaults to 10.
+	MaxRedirects int `json:"max_redirects"`
+	// ProxyURL proxies every delivery. Defaults to the HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY environment variables.
+	ProxyURL string `json:"proxy_url"`
+	// MaxResponseBytes caps how much of a response body is read. Defaults to
+	// 1MiB.
+	MaxResponseBytes int64 `json:"max_response_bytes"`
+	// StoredResponseBytes caps how much of a response body is stored on the
+	// job. Defaults to 64KiB.
+	StoredResponseBytes int64 `json:"stored_response_bytes"`
+	// StoredResponseHeaders are the response headers stored on the job.
+	// Defaults to Content-Type and Location.
+	StoredResponseHeaders []string `json:"stored_response_headers"`
+	// TLS configures client certificates, root CAs and pins for every host
+	TLS *TLSConfig `json:"tls"`
+	// Hosts overrides the config for hosts matching a pattern. Patterns match
+	// a host exactly or, when prefixed with "*.", any subdomain.
+	Hosts map[string]HostConfig `json:"hosts"`
+	// HostLimit limits the deliveries to every host unless the host sets its
+	// own. Defaults to unlimited.
+	HostLimit RateLimit `json:"host_limit"`
+	// RateLimitGroups limit the deliveries of jobs that name a group
+	RateLimitGroups map[string]RateLimit `json:"rate_limit_groups"`
+	// Breaker stops deliveries to hosts that keep failing
+	Breaker BreakerConfig `json:"breaker"`
+	// Callbacks configures how events are sent to callback URIs
+	Callbacks CallbackConfig `json:"callbacks"`
+}
+
+func (c ClientConfig) withDefaults() ClientConfig {
+	if c.ConnectTimeout.Duration == 0 {
+		c.ConnectTimeout.Duration = 10 * time.Second
+	}
+	if c.TLSHandshakeTimeout.Duration == 0 {
+		c.TLSHandshakeTimeout.Duration = 10 * time.Second
+	}
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = 30 * time.Second
+	}
+	if c.IdleConnTimeout.Duration == 0 {
+		c.IdleConnTimeout.Duration = 90 * time.Second
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 100
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = 10
+	}
+	if c.MaxRedirects == 0 {
+		c.MaxRedirects = 10
+	}
+	if c.MaxResponseBytes == 0 {
+		c.MaxResponseBytes = 1 << 20
+	}
+	if c.StoredResponseBytes == 0 {
+		c.StoredResponseBytes = 64 << 10
+	}
+	if c.StoredResponseHeaders == nil {
+		c.StoredResponseHeaders = []string{"Content-Type", "Location"}
+	}
+	if c.Breaker.FailureThreshold == 0 {
+		c.Breaker.FailureThreshold = 5
+	}
+	if c.Breaker.Cooldown.Duration == 0 {
+		c.Breaker.Cooldown.Duration = 30 * time.Second
+	}
+	if c.Callbacks.PollInterval.Duration == 0 {
+		c.Callbacks.PollInterval.Duration = 5 * time.Second
+	}
+	if c.Callbacks.BatchSize == 0 {
+		c.Callbacks.BatchSize = 100
+	}
+	if c.Callbacks.MaxRetries == 0 {
+		c.Callbacks.MaxRetries = 10
+	}
+	if c.Callbacks.RetryBackoff.Duration == 0 {
+		c.Callbacks.RetryBackoff.Duration = 10 * time.Second
+	}
+
+	return c
+}
+
+// newClient builds the delivery client. Every connection it dials is checked
+// against policy, including connections to a proxy.
+func newClient(cfg ClientConfig, policy *TargetPolicy) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	// proxies dial targets themselves so targets are checked before a
+	// request is handed to a proxy and the proxies are dialed without checks
+	proxies := proxyAddrs(cfg.ProxyURL)
+	if policy != nil {
+		proxy = checkedProxy(proxy, policy)
+	}
+
+	fallback, err := newTransport(cfg, cfg.TLS, proxy, policy, proxies)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns, hosts := sortHostPatterns(cfg.Hosts)
+	router := &hostRoundTripper{patterns: patterns, fallback: fallback}
+	for _, pattern := range patterns {
+		tlsCfg := cfg.TLS
+		if hostTLS := hosts[pattern].TLS; hostTLS != nil {
+			tlsCfg = hostTLS
+		}
+
+		transport, err := newTransport(cfg, tlsCfg, proxy, policy, proxies)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %s", pattern, err)
+		}
+		router.transports = append(router.transports, transport)
+	}
+
+	return &http.Client{
+		Transport: &timeoutRoundTripper{
+			next: router,
+			defaults: dialTimeouts{
+				connect:   cfg.ConnectTimeout.Duration,
+				handshake: cfg.TLSHandshakeTimeout.Duration,
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// the 3xx is returned so that the job's success criteria decide
+			// what a redirect that is not followed means
+			if !cfg.FollowRedirects || len(via) >= cfg.MaxRedirects {
+				return http.ErrUseLastResponse
+			}
+
+			return nil
+		},
+	}, nil
+}
+
+func newTransport(cfg ClientConfig, tlsCfg *TLSConfig, proxy func(*http.Request) (*url.URL, error), policy *TargetPolicy, proxies []string) (*http.Transport, error) {
+	tlsClientConfig, err := tlsCfg.build()
+	if err != nil {
+		return nil, err
+	}
+
+	// the connect and TLS handshake timeouts are set per request by
+	// timeoutRoundTripper
+	dial := policy.DialContext(&net.Dialer{KeepAlive: 30 * time.Second}, proxies...)
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if timeouts, ok := ctx.Value(dialTimeoutsKey{}).(dialTimeouts); ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeouts.connect)
+				defer cancel()
+			}
+
+			return dial(ctx, network, addr)
+		},
+		TLSClientConfig:     tlsClientConfig,
+		IdleConnTimeout:     cfg.IdleConnTimeout.Duration,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+	}, nil
+}
+
+// checkedProxy checks a request's target against policy before it is sent
+// through a proxy. The proxy resolves the target again so the check cannot
+// rule out DNS rebinding, but it keeps proxied requests from reaching
+// addresses the policy denies.
+func checkedProxy(proxy func(*http.Request) (*url.URL, error), policy *TargetPolicy) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		if err := policy.CheckHost(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+
+		return proxyURL, nil
+	}
+}
+
+// proxyAddrs returns the host:port of the configured proxy or, without one,
+// of the proxies in the environment
+func proxyAddrs(proxyURL string) []string {
+	raws := []string{proxyURL}
+	if proxyURL == "" {
+		raws = []string{os.Getenv("HTTP_PROXY"), os.Getenv("http_proxy"), os.Getenv("HTTPS_PROXY"), os.Getenv("https_proxy")}
+	}
+
+	var addrs []string
+	for _, raw := range raws {
+		if raw == "" {
+			continue
+		}
+
+		// like net/http, proxies without a scheme are http proxies
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			if u, err = url.Parse("http://" + raw); err != nil {
+				continue
+			}
+		}
+
+		port := u.Port()
+		if port == "" {
+			switch u.Scheme {
+			case "https":
+				port = "443"
+			case "socks5":
+				port = "1080"
+			default:
+				port = "80"
+			}
+		}
+		addrs = append(addrs, net.JoinHostPort(u.Hostname(), port))
+	}
+
+	return addrs
+}
+
+// sortHostPatterns lowercases host patterns and orders them so that exact
+// hosts are matched before wildcards and longer wildcards before shorter ones
+func sortHostPatterns(hosts map[string]HostConfig) ([]string, map[string]HostConfig) {
+	patterns := make([]string, 0, len(hosts))
+	lowered := make(map[string]HostConfig, len(hosts))
+	for pattern, hostCfg := range hosts {
+		pattern = strings.ToLower(pattern)
+		lowered[pattern] = hostCfg
+		patterns = append(patterns, pattern)
+	}
+
+	sort.Slice(patterns, func(a, b int) bool {
+		wildA, wildB := strings.HasPrefix(patterns[a], "*."), strings.HasPrefix(patterns[b], "*.")
+		if wildA != wildB {
+			return !wildA
+		}
+		return len(patterns[a]) > len(patterns[b])
+	})
+
+	return patterns, lowered
+}
+
+type dialTimeoutsKey struct{}
+
+// dialTimeouts limit dialing a connection and its TLS handshake
+type dialTimeouts struct {
+	connect   time.Duration
+	handshake time.Duration
+}
+
+// withDialTimeouts overrides the client's connect and TLS handshake timeouts
+// for requests made with ctx. Zero values keep the client's.
+func withDialTimeouts(ctx context.Context, connect, handshake time.Duration) context.Context {
+	return context.WithValue(ctx, dialTimeoutsKey{}, dialTimeouts{connect: connect, handshake: handshake})
+}
+
+// timeoutRoundTripper applies the connect and TLS handshake timeouts of a
+// request, or the defaults, to the connection it is sent on. The transports
+// have no timeouts of their own so that jobs can raise the defaults as well as
+// lower them.
+type timeoutRoundTripper struct {
+	next     http.RoundTripper
+	defaults dialTimeouts
+}
+
+func (t *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeouts := t.defaults
+	if override, ok := req.Context().Value(dialTimeoutsKey{}).(dialTimeouts); ok {
+		if override.connect > 0 {
+			timeouts.connect = override.connect
+		}
+		if override.handshake > 0 {
+			timeouts.handshake = override.handshake
+		}
+	}
+
+	// a slow handshake cancels the request
+	ctx, cancel := context.WithCancel(context.WithValue(req.Context(), dialTimeoutsKey{}, timeouts))
+	var timedOut int32
+	var timer *time.Timer
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			timer = time.AfterFunc(timeouts.handshake, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				cancel()
+			})
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if timer != nil {
+				timer.Stop()
+			}
+		},
+	})
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, fmt.Errorf("TLS handshake timed out after %s", timeouts.handshake)
+		}
+		return nil, err
+	}
+
+	// the body is read after RoundTrip returns so the context lives until it
+	// is closed
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels a request's context once its response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -2,148 +2,796 @@ package processors
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cbelsole/dsw/db"
 	"github.com/cbelsole/dsw/types"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
 )
 
-// Job is a processor responsible for enqueuing, running, and completing jobs
-type Job struct {
-	DB                    *db.DB
+// DB stores the jobs, tenants, credentials, pauses and callbacks a processor
+// works with. It is implemented by *db.DB.
+type DB interface {
+	CreateJob(job *types.Job) (bool, error)
+	GetPendingJob(id uuid.UUID) (*types.Job, error)
+	GetPendingJobs(before time.Time, limit int, skipQueues, skipHosts []string) ([]*types.Job, error)
+	CountPendingJobsByQueue() (map[string]int, error)
+	ClaimJob(id uuid.UUID, owner string, ttl time.Duration) (bool, error)
+	RenewLease(id uuid.UUID, owner string, ttl time.Duration) (bool, error)
+	ReleaseJob(id uuid.UUID, owner string) error
+	UpdateJob(job *types.Job, owner string) error
+	ExpireJob(job *types.Job) (bool, error)
+	GetTenant(id string) (*types.Tenant, error)
+	GetCredential(tenantID, name string) (*types.Credential, error)
+	GetPauses() ([]*types.Pause, error)
+	SavePause(p *types.Pause) error
+	DeletePause(scope, target string) (bool, error)
+	ClaimCallbacks(limit int, ttl time.Duration) ([]*types.Callback, error)
+	RetryCallback(id uuid.UUID, nextAttemptAt time.Time) error
+	DeleteCallback(id uuid.UUID) error
+}
+
+var _ DB = (*db.DB)(nil)
+
+// Config configures a Job processor
+type Config struct {
+	// Name identifies the processor in logs and metrics. Defaults to
+	// "default".
+	Name                  string
+	DB                    DB
 	WorkerNum, MaxRetries int
+	// Policy restricts the targets jobs are delivered to. A nil Policy allows
+	// every target.
+	Policy *TargetPolicy
+	// Client tunes the HTTP client jobs are delivered with
+	Client ClientConfig
+	// ListenURL is the postgres url used to LISTEN for jobs created or
+	// updated by any instance. Jobs are only polled when it is empty.
+	ListenURL string
+	// Window is how far ahead pending jobs are loaded into memory. Defaults
+	// to 10 minutes.
+	Window time.Duration
+	// RefillInterval is how often the window is reloaded. Defaults to a
+	// minute.
+	RefillInterval time.Duration
+	// MaxLoadedJobs caps how many jobs are loaded into the window at once.
+	// Defaults to 10000.
+	MaxLoadedJobs int
+	// QueueSize is how many claimed jobs may wait for a free worker. Due jobs
+	// are only claimed while there is room. Defaults to 100.
+	QueueSize int
+	// LeaseTTL is how long a claimed job is leased to this instance before
+	// other instances may claim it. It must cover a job's time in the queue.
+	// The lease is renewed every third of it while the job is delivered.
+	// Defaults to 5 minutes.
+	LeaseTTL time.Duration
+	// ReservedWorkers are only given to jobs with a priority of at least
+	// HighPriority so that floods of lower priority jobs cannot starve them.
+	// Lower priority jobs are only claimed while more workers are idle.
+	// Defaults to none.
+	ReservedWorkers int
+	HighPriority    int
+	// Queues configures named queues, each with its own workers. The default
+	// queue uses WorkerNum and MaxRetries unless it is configured here.
+	Queues map[string]QueueConfig
 }
 
-var (
-	jobs           sync.Map
-	started        sync.Once
-	jobQueue       = make(chan *types.Job, 100)
-	results        = make(chan *types.Job, 100)
+// Job is a processor responsible for enqueuing, running, and completing jobs
+type Job struct {
+	Config
+
+	client         *http.Client
+	queues         map[string]*queue
 	processingJobs sync.Map
-)
+	tenants        sync.Map
+	tokenSources   sync.Map
+	// hostLimiters holds a limiter per target host, groupLimiters one per
+	// configured rate limit group
+	hostLimiters sync.Map
+	// breakers holds a circuit breaker per target host
+	breakers      sync.Map
+	groupLimiters map[string]*limiter
+	hostPatterns  []string
+	hosts         map[string]HostConfig
+	// pauses holds the *pauseSet loaded from the db
+	pauses atomic.Value
+	// loadedUntil is the unix nano time up to which every pending job has
+	// been loaded into the schedule
+	loadedUntil int64
+	// instanceID identifies this processor's leases
+	instanceID string
+
+	mu      sync.Mutex
+	running bool
+	results chan *types.Job
+	// wake wakes the dispatcher when a schedule changes or a worker frees up
+	wake     chan struct{}
+	listener *pq.Listener
+	// stop is closed to stop claiming and starting jobs
+	stop chan struct{}
+	// dispatching and working track the dispatcher and workers so that Stop
+	// can wait for them
+	dispatching, working sync.WaitGroup
+	// saved is closed once every result has been saved
+	saved chan struct{}
+	// deliveries is cancelled when Stop's deadline passes to abort in flight
+	// deliveries
+	deliveries       context.Context
+	cancelDeliveries context.CancelFunc
+}
+
+// New returns a processor configured by cfg. Call Start to begin processing.
+func New(cfg Config) (*Job, error) {
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+	if cfg.Window == 0 {
+		cfg.Window = 10 * time.Minute
+	}
+	if cfg.RefillInterval == 0 {
+		cfg.RefillInterval = time.Minute
+	}
+	if cfg.MaxLoadedJobs == 0 {
+		cfg.MaxLoadedJobs = 10000
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.LeaseTTL == 0 {
+		cfg.LeaseTTL = 5 * time.Minute
+	}
+	cfg.Client = cfg.Client.withDefaults()
+
+	client, err := newClient(cfg.Client, cfg.Policy)
+	if err != nil {
+		return nil, err
+	}
 
-// Start adds a job to the pool
+	j := &Job{
+		Config:        cfg,
+		client:        client,
+		wake:          make(chan struct{}, 1),
+		groupLimiters: map[string]*limiter{},
+		instanceID:    uuid.NewV4().String(),
+	}
+	j.newQueues()
+	j.pauses.Store(&pauseSet{queues: map[string]bool{}})
+	j.hostPatterns, j.hosts = sortHostPatterns(cfg.Client.Hosts)
+	for name, limit := range cfg.Client.RateLimitGroups {
+		j.groupLimiters[name] = newLimiter(limit)
+	}
+	j.publishMetrics()
+
+	return j, nil
+}
+
+// Start loads the pending jobs and starts the workers. Starting a running
+// processor does nothing and a stopped processor can be started again.
 func (j *Job) Start() error {
-	var err error
-	started.Do(func() {
-		var loadedJobs []*types.Job
-		loadedJobs, err = j.DB.GetPendingJobs()
-		if err != nil {
-			return
-		}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running {
+		return nil
+	}
 
-		for _, job := range loadedJobs {
-			jobs.Store(job.ID.String(), job)
+	// the channels never block since no more jobs than they can hold are
+	// ever claimed
+	capacity := 0
+	for _, q := range j.queues {
+		q.jobs = make(chan *types.Job, q.WorkerNum+j.QueueSize)
+		capacity += q.WorkerNum + j.QueueSize
+	}
+	j.results = make(chan *types.Job, capacity)
+	j.stop = make(chan struct{})
+	j.saved = make(chan struct{})
+	j.deliveries, j.cancelDeliveries = context.WithCancel(context.Background())
+
+	if err := j.loadPauses(); err != nil {
+		return err
+	}
+
+	if err := j.refill(); err != nil {
+		return err
+	}
+
+	if j.ListenURL != "" {
+		if err := j.listen(); err != nil {
+			return err
 		}
+	}
 
-		for w := 0; w < j.WorkerNum; w++ {
-			go j.worker(w, jobQueue, results)
+	for _, q := range j.queues {
+		j.working.Add(q.WorkerNum)
+		for w := 0; w < q.WorkerNum; w++ {
+			go j.worker(w, q.jobs, j.results)
 		}
+	}
+
+	// sleep until the next job is due, the schedule changes or a worker
+	// frees up
+	j.dispatching.Add(1)
+	go func() {
+		defer j.dispatching.Done()
 
-		go func() {
-			for range time.Tick(5 * time.Second) {
-				for _, j := range j.getJobs() {
-					jobQueue <- j
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-j.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			case <-j.wake:
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
 				}
 			}
-		}()
-
-		go func() {
-			for job := range results {
-				if err := j.DB.UpdateJob(job); err != nil {
-					log.Printf("error saving job %+v, error: %s\n", job, err)
-				} else {
-					log.Printf("processed job %+v\n", job)
+
+			wait := j.RefillInterval
+			for _, q := range j.queues {
+				due, saturated := j.dueJobs(q)
+				for _, job := range due {
+					q.jobs <- job
 				}
 
-				// Remove completed jobs
-				jobs.Store(job.ID.String(), job)
-				processingJobs.Delete(job.ID.String())
+				// a saturated queue is woken up by the next saved result
+				if !saturated {
+					if next := q.pending.next(time.Now(), wait); next < wait {
+						wait = next
+					}
+				}
+			}
+			timer.Reset(wait)
+		}
+	}()
+
+	// rolling the window forward is also a fallback for missed notifications.
+	// Stop does not wait for it so it keeps its own reference to stop in case
+	// the processor is restarted.
+	stop := j.stop
+	go func() {
+		ticker := time.NewTicker(j.RefillInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			j.reloadPauses()
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(j.Client.Callbacks.PollInterval.Duration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
 			}
-		}()
-	})
 
-	return err
+			j.sendCallbacks()
+		}
+	}()
+
+	go func() {
+		defer close(j.saved)
+
+		for job := range j.results {
+			err := j.DB.UpdateJob(job, j.instanceID)
+			if err == db.ErrLeaseLost {
+				// another instance claimed or changed the job after the
+				// lease ran out, its result is the one that counts
+				log.Printf("dropped the result of job %s, %s\n", job.ID, err)
+			} else if err != nil {
+				log.Printf("error saving job %s, error: %s\n", job.ID, err)
+			} else {
+				logJob("processed", job)
+				if job.Status == types.StatusExpired {
+					expiredJobs.Add(j.Name, 1)
+				}
+				j.notify(job)
+			}
+
+			// completed jobs are not rescheduled
+			j.releaseLimits(job)
+			j.abandonProbe(job)
+			j.processingJobs.Delete(job.ID.String())
+			if job.Pending() && err != db.ErrLeaseLost {
+				j.schedule(job)
+			}
+
+			atomic.AddInt64(&j.queue(job).inFlight, -1)
+			j.wakeup()
+		}
+	}()
+
+	j.running = true
+	return nil
 }
 
-// Enqueue adds a job to the pool
-func (j *Job) Enqueue(job *types.Job) error {
-	if err := j.DB.CreateJob(job); err != nil {
-		return err
+// Stop stops claiming jobs and waits for in flight deliveries to finish and
+// be saved. Deliveries still running when ctx is done are aborted. Their
+// leases, and the leases of claimed jobs that were never started, are
+// released so that another instance can claim them right away.
+func (j *Job) Stop(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.running {
+		return nil
 	}
+	j.running = false
 
-	jobs.Store(job.ID.String(), job)
+	close(j.stop)
+	if j.listener != nil {
+		j.listener.Close()
+		j.listener = nil
+	}
+	j.dispatching.Wait()
 
-	return nil
+	done := make(chan struct{})
+	go func() {
+		j.working.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("%s: aborting in flight deliveries\n", j.Name)
+		j.cancelDeliveries()
+		<-done
+	}
+	j.cancelDeliveries()
+
+	close(j.results)
+	<-j.saved
+
+	for _, q := range j.queues {
+		for len(q.jobs) > 0 {
+			job := <-q.jobs
+			j.refundLimits(job)
+			j.release(job)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// CheckURI returns an error if jobs may not be delivered to uri
+func (j *Job) CheckURI(uri string) error {
+	return j.Policy.CheckURI(uri)
+}
+
+// wakeup wakes the dispatcher
+func (j *Job) wakeup() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// release gives up this processor's lease on a job it will not send
+func (j *Job) release(job *types.Job) {
+	if err := j.DB.ReleaseJob(job.ID, j.instanceID); err != nil {
+		log.Printf("error releasing job %s: %s\n", job.ID, err)
+	}
+	j.releaseLimits(job)
+	j.abandonProbe(job)
+	j.processingJobs.Delete(job.ID.String())
+	atomic.AddInt64(&j.queue(job).inFlight, -1)
+}
+
+// keepLease renews this processor's lease on a job until the returned function
+// is called since a delivery can take longer than LeaseTTL. It reports whether
+// the lease was still held.
+func (j *Job) keepLease(job *types.Job) (bool, func()) {
+	held, err := j.DB.RenewLease(job.ID, j.instanceID, j.LeaseTTL)
+	if err != nil {
+		// saving the job fails if the lease is lost in the meantime
+		log.Printf("error renewing the lease on job %s: %s\n", job.ID, err)
+	} else if !held {
+		return false, func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(j.LeaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			held, err := j.DB.RenewLease(job.ID, j.instanceID, j.LeaseTTL)
+			if err != nil {
+				log.Printf("error renewing the lease on job %s: %s\n", job.ID, err)
+			} else if !held {
+				log.Printf("lost the lease on job %s while sending it\n", job.ID)
+				return
+			}
+		}
+	}()
+
+	return true, func() { close(done) }
+}
+
+// expire marks a scheduled job expired unless another instance claimed it
+func (j *Job) expire(job *types.Job) {
+	expired, err := j.DB.ExpireJob(job)
+	if err != nil {
+		// the job is loaded again when the window rolls forward
+		log.Printf("error expiring job %s: %s\n", job.ID, err)
+		return
+	}
+
+	if expired {
+		logJob("expired", job)
+		expiredJobs.Add(j.Name, 1)
+		j.notify(job)
+	}
+}
+
+// Enqueue adds a job and the jobs that run after it to the pool. It reports
+// whether the job was created or deduplicated with a pending job.
+func (j *Job) Enqueue(job *types.Job) (bool, error) {
+	j.setDefaults(job)
+
+	created, err := j.DB.CreateJob(job)
+	if err != nil {
+		return false, err
+	}
+
+	j.schedule(job)
+
+	return created, nil
+}
+
+// setDefaults sets the tenant, queue and max retries of a job and the jobs
+// created with it
+func (j *Job) setDefaults(job *types.Job) {
+	if job.TenantID == "" {
+		job.TenantID = types.DefaultTenant
+	}
+
+	if job.Queue == "" {
+		job.Queue = types.DefaultQueue
+	}
+
+	if job.MaxRetries == 0 {
+		job.MaxRetries = j.queue(job).MaxRetries
+	}
+
+	for _, child := range []*types.Job{job.OnSuccess, job.OnFailure} {
+		if child != nil {
+			child.TenantID = job.TenantID
+			j.setDefaults(child)
+		}
+	}
 }
 
 func (j *Job) worker(id int, processing <-chan *types.Job, results chan<- *types.Job) {
-	for job := range processing {
-		log.Printf("starting job %+v\n", job)
+	defer j.working.Done()
+
+	for {
+		// stopping takes precedence over starting another job
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+
+		var job *types.Job
+		select {
+		case <-j.stop:
+			return
+		case job = <-processing:
+		}
+
+		// jobs that expired while they waited for a worker are not sent
+		if job.Expired(time.Now()) {
+			job.Expire()
+			j.refundLimits(job)
+			results <- job
+			continue
+		}
+
+		// a Try of -1 marks a job that failed for good. Payloads that cannot
+		// be encoded never will be so the job is not retried.
+		logJob("starting", job)
 		payload, err := json.Marshal(job.Payload)
 		if err != nil {
 			job.Errors = append(job.Errors, err.Error())
+			job.Try = -1
+			job.Status = types.StatusFailed
 			results <- job
 			continue
 		}
 
-		resp, err := http.Post(job.URI, "application/json", bytes.NewBuffer(payload))
+		// the tenant signs the payload. Failing to load it is not the host's
+		// fault and may go away so the job is retried.
+		tenant, err := j.tenant(job.TenantID)
 		if err != nil {
+			j.abandonProbe(job)
+			j.retry(job, fmt.Errorf("error loading tenant %s: %s", job.TenantID, err))
+			logJob("finished", job)
+			results <- job
+			continue
+		}
+
+		// the lease may have run out while the job waited for a worker
+		held, stopRenewing := j.keepLease(job)
+		if !held {
+			log.Printf("lost the lease on job %s before sending it\n", job.ID)
+			j.refundLimits(job)
+			j.release(job)
+			continue
+		}
+
+		resp, b, err := j.deliver(job, tenant, payload)
+		stopRenewing()
+		if err != nil && j.deliveries.Err() != nil {
+			// the delivery was aborted by Stop, not by the target
+			logJob("aborted", job)
+			j.release(job)
+			continue
+		}
+
+		// token errors are the token endpoint's, not the host's, and
+		// may go away so the job is retried
+		var tokenErr *tokenError
+		if errors.As(err, &tokenErr) {
+			j.abandonProbe(job)
+			j.retry(job, err)
+			logJob("finished", job)
+			results <- job
+			continue
+		}
+
+		// targets the policy denies never will be allowed so the job fails
+		// for good without counting against the host
+		var policyErr *policyError
+		if errors.As(err, &policyErr) {
+			j.abandonProbe(job)
 			job.Errors = append(job.Errors, err.Error())
 			job.Try = -1
+			job.Status = types.StatusFailed
+			logJob("finished", job)
+			results <- job
+			continue
+		}
+
+		// the host is failing when it cannot be reached or returns a 5xx
+		j.recordDelivery(job, err != nil || resp.StatusCode >= 500)
+
+		if err != nil {
+			// timeouts and connection errors may go away
+			j.retry(job, err)
 		} else {
-			b, err := ioutil.ReadAll(resp.Body)
-			fmt.Println("body: ", string(b))
-			if err != nil {
-				job.Errors = append(job.Errors, fmt.Sprintf("error reading body %s", err))
-			}
+			job.Response = j.newResponse(resp, b)
 
-			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			switch outcome, reason := job.SuccessCriteria.Classify(resp.StatusCode, b); outcome {
+			case types.OutcomeSuccess:
 				job.Sent = true
-			} else if resp.StatusCode >= 400 && resp.StatusCode <= 499 {
-				job.Errors = append(job.Errors, fmt.Sprintf("URI returned 400: %s", string(b)))
+				job.Status = types.StatusSucceeded
+			case types.OutcomeRetry:
+				j.retry(job, reason)
+			default:
+				job.Errors = append(job.Errors, reason.Error())
 				job.Try = -1
-			} else if resp.StatusCode >= 500 && resp.StatusCode <= 599 {
-				job.Try++
+				job.Status = types.StatusFailed
 			}
-
-			resp.Body.Close()
 		}
 
-		log.Printf("finished job %+v\n", job)
+		logJob("finished", job)
 		results <- job
 	}
 }
 
-func (j *Job) getJobs() []*types.Job {
-	var sendableJobs []*types.Job
+// logJob logs what happened to a job by its ID, status and try only. Its
+// payload, errors and response may hold customer data.
+func logJob(event string, job *types.Job) {
+	log.Printf("%s job %s, status: %s, try: %d\n", event, job.ID, job.Status, job.Try)
+}
+
+// retry schedules another attempt of a job at next_attempt_at, failing it
+// once it is out of retries and expiring it if the attempt would be too late.
+// The queue's retry backoff doubles with every try.
+func (j *Job) retry(job *types.Job, reason error) {
+	job.Try++
+	nextAttemptAt := time.Now().Add(j.queue(job).RetryBackoff.Duration << uint(job.Try-1))
+	job.NextAttemptAt = &nextAttemptAt
+	if job.Try >= job.MaxRetries {
+		job.Errors = append(job.Errors, reason.Error())
+		job.Status = types.StatusFailed
+	} else if job.Expired(nextAttemptAt) {
+		// the retry would be too late
+		job.Errors = append(job.Errors, reason.Error())
+		job.Expire()
+	}
+}
+
+// deliver posts the payload to the job's URI and reads up to
+// Client.MaxResponseBytes of the response body within the job's timeouts
+func (j *Job) deliver(job *types.Job, tenant *tenantEntry, payload []byte) (*http.Response, []byte, error) {
+	timeout := j.Client.Timeout.Duration
+	if job.Timeout != nil {
+		timeout = job.Timeout.Duration
+	}
+
+	ctx, cancel := context.WithTimeout(j.deliveries, timeout)
+	defer cancel()
+
+	var connectTimeout, tlsTimeout time.Duration
+	if job.ConnectTimeout != nil {
+		connectTimeout = job.ConnectTimeout.Duration
+	}
+	if job.TLSTimeout != nil {
+		tlsTimeout = job.TLSTimeout.Duration
+	}
+	ctx = withDialTimeouts(ctx, connectTimeout, tlsTimeout)
+
+	resp, b, err := j.send(ctx, job, tenant, payload)
+
+	// the cached token may have been revoked so fetch a new one and try again
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && job.Credential != nil {
+		j.invalidateToken(job.TenantID, *job.Credential)
+		resp, b, err = j.send(ctx, job, tenant, payload)
+	}
+
+	return resp, b, err
+}
+
+func (j *Job) send(ctx context.Context, job *types.Job, tenant *tenantEntry, payload []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, job.URI, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	if job.Credential != nil {
+		accessToken, err := j.accessToken(ctx, job.TenantID, *job.Credential)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	if signature := tenant.sign(payload); signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, j.Client.MaxResponseBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading body %s", err)
+	}
+
+	return resp, b, nil
+}
+
+// dueJobs claims as many of a queue's due jobs as there is room for, highest
+// priority first. saturated reports whether due jobs had to be left on the
+// schedule.
+func (j *Job) dueJobs(q *queue) (due []*types.Job, saturated bool) {
 	now := time.Now()
 
-	jobs.Range(func(key, value interface{}) bool {
-		job := value.(*types.Job)
+	// paused queues are woken up when they are resumed
+	if atomic.LoadInt32(&q.paused) == 1 {
+		return nil, true
+	}
 
-		log.Printf("checking job %+v\n", job)
-		// Remove completed jobs
-		if job.Sent || job.Try == -1 || job.Try >= j.MaxRetries {
-			jobs.Delete(key)
-			processingJobs.Delete(key)
-			return true
+	inFlight := int(atomic.LoadInt64(&q.inFlight))
+	free := q.WorkerNum + j.QueueSize - inFlight
+	if free <= 0 {
+		return nil, q.pending.next(now, time.Second) <= 0
+	}
+
+	// lower priority jobs only get idle workers beyond the reserved ones so
+	// they never wait for a worker and high priority jobs never wait behind
+	// them in the queue
+	maxLow := q.WorkerNum - j.ReservedWorkers - inFlight
+	popped, saturated := q.pending.popDue(now, free, maxLow, j.HighPriority)
+	if saturated {
+		queueSaturated.Add(j.Name, 1)
+		log.Printf("%s: queue %s is saturated with %d jobs in flight\n", j.Name, q.name, atomic.LoadInt64(&q.inFlight)+int64(len(popped)))
+	}
+
+	for _, job := range popped {
+		// expired jobs are dropped from the schedule without being sent
+		if job.Expired(now) {
+			j.expire(job)
+			continue
 		}
 
-		// enqueue jobs that are not processing
-		if _, found := processingJobs.Load(key); !found && !job.ExecuteAt.After(now) {
-			sendableJobs = append(sendableJobs, job)
-			processingJobs.Store(key, true)
+		// paused jobs are dropped from the schedule and loaded again when
+		// they are resumed
+		if j.paused(job) {
+			continue
 		}
 
-		return true
-	})
+		// defer jobs over their tenant's delivery rate. The delivery is
+		// refunded if the job is deferred for another reason below.
+		tenant, err := j.tenant(job.TenantID)
+		if err != nil {
+			log.Printf("error loading tenant %s: %s\n", job.TenantID, err)
+			q.pending.push(job, now.Add(time.Second))
+			continue
+		}
+		if !tenant.allow() {
+			q.pending.push(job, now.Add(time.Second))
+			continue
+		}
+
+		// defer jobs to hosts whose circuit breaker is open without using up
+		// a try
+		if ok, retryAt := j.allowHost(job, now); !ok {
+			tenant.refund()
+			q.pending.push(job, retryAt)
+			continue
+		}
+
+		// defer jobs over their host's or rate limit group's limits
+		if !j.acquireLimits(job) {
+			tenant.refund()
+			j.abandonProbe(job)
+			q.pending.push(job, now.Add(limitDeferral))
+			continue
+		}
+
+		// another instance may have claimed the job, it is scheduled again
+		// if that instance fails to send it
+		claimed, err := j.DB.ClaimJob(job.ID, j.instanceID, j.LeaseTTL)
+		if err != nil {
+			log.Printf("error claiming job %s: %s\n", job.ID, err)
+			tenant.refund()
+			j.releaseLimits(job)
+			j.refundLimits(job)
+			j.abandonProbe(job)
+			q.pending.push(job, now.Add(time.Second))
+			continue
+		}
+		if !claimed {
+			tenant.refund()
+			j.releaseLimits(job)
+			j.refundLimits(job)
+			j.abandonProbe(job)
+			continue
+		}
+
+		due = append(due, job)
+		j.processingJobs.Store(job.ID.String(), true)
+		atomic.AddInt64(&q.inFlight, 1)
+	}
 
-	return sendableJobs
+	return due, saturated
 }
@@ -0,0 +1,429 @@
+package processors
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbelsole/dsw/db"
+	"github.com/cbelsole/dsw/types"
+	uuid "github.com/satori/go.uuid"
+)
+
+// fakeDB keeps jobs in memory and sends every saved job on saved
+type fakeDB struct {
+	mu     sync.Mutex
+	jobs   map[uuid.UUID]*types.Job
+	leases map[uuid.UUID]string
+	saved  chan *types.Job
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		jobs:   map[uuid.UUID]*types.Job{},
+		leases: map[uuid.UUID]string{},
+		saved:  make(chan *types.Job, 100),
+	}
+}
+
+func (f *fakeDB) CreateJob(job *types.Job) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	job.ID = uuid.NewV4()
+	job.Status = types.StatusPending
+	job.CreatedAt = time.Now()
+	saved := *job
+	f.jobs[job.ID] = &saved
+	return true, nil
+}
+
+func (f *fakeDB) GetPendingJob(id uuid.UUID) (*types.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if job, ok := f.jobs[id]; ok && job.Pending() {
+		loaded := *job
+		return &loaded, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) GetPendingJobs(before time.Time, limit int, skipQueues, skipHosts []string) ([]*types.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	skip := map[string]bool{}
+	for _, queue := range skipQueues {
+		skip[queue] = true
+	}
+
+	var jobs []*types.Job
+	for _, job := range f.jobs {
+		if job.Pending() && !skip[job.Queue] && !matchHost(skipHosts, jobHost(job)) && job.DueAt().Before(before) {
+			loaded := *job
+			jobs = append(jobs, &loaded)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].DueAt().Before(jobs[b].DueAt()) })
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+
+	return jobs, nil
+}
+
+func (f *fakeDB) CountPendingJobsByQueue() (map[string]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, job := range f.jobs {
+		if job.Pending() {
+			counts[job.Queue]++
+		}
+	}
+	return counts, nil
+}
+
+func (f *fakeDB) ClaimJob(id uuid.UUID, owner string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	job, ok := f.jobs[id]
+	if !ok || !job.Pending() || (f.leases[id] != "" && f.leases[id] != owner) {
+		return false, nil
+	}
+	f.leases[id] = owner
+	return true, nil
+}
+
+func (f *fakeDB) RenewLease(id uuid.UUID, owner string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.leases[id] == owner, nil
+}
+
+func (f *fakeDB) ReleaseJob(id uuid.UUID, owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.leases[id] == owner {
+		delete(f.leases, id)
+	}
+	return nil
+}
+
+func (f *fakeDB) UpdateJob(job *types.Job, owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.leases[job.ID] != owner {
+		return db.ErrLeaseLost
+	}
+	delete(f.leases, job.ID)
+	saved := *job
+	f.jobs[job.ID] = &saved
+	f.saved <- &saved
+	return nil
+}
+
+func (f *fakeDB) ExpireJob(job *types.Job) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.jobs[job.ID]
+	if !ok || !stored.Pending() || f.leases[job.ID] != "" || !stored.Expired(time.Now()) {
+		return false, nil
+	}
+	expired := *stored
+	expired.Expire()
+	f.jobs[job.ID] = &expired
+	*job = expired
+	return true, nil
+}
+
+func (f *fakeDB) leased(id uuid.UUID) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.leases[id] != ""
+}
+
+func (f *fakeDB) GetTenant(id string) (*types.Tenant, error) {
+	return &types.Tenant{ID: id}, nil
+}
+
+func (f *fakeDB) GetCredential(tenantID, name string) (*types.Credential, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) GetPauses() ([]*types.Pause, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) SavePause(p *types.Pause) error {
+	return nil
+}
+
+func (f *fakeDB) DeletePause(scope, target string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeDB) ClaimCallbacks(limit int, ttl time.Duration) ([]*types.Callback, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) RetryCallback(id uuid.UUID, nextAttemptAt time.Time) error {
+	return nil
+}
+
+func (f *fakeDB) DeleteCallback(id uuid.UUID) error {
+	return nil
+}
+
+func newTestProcessor(t *testing.T, fake *fakeDB) *Job {
+	t.Helper()
+
+	j, err := New(Config{Name: t.Name(), DB: fake, WorkerNum: 2, MaxRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func waitForSave(t *testing.T, fake *fakeDB) *types.Job {
+	t.Helper()
+
+	select {
+	case job := <-fake.saved:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("no job was saved")
+		return nil
+	}
+}
+
+func TestJobEnqueue(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	fake := newFakeDB()
+	j := newTestProcessor(t, fake)
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &types.Job{URI: target.URL, ExecuteAt: time.Now()}
+	if created, err := j.Enqueue(job); err != nil || !created {
+		t.Fatalf("Enqueue = %t, %v", created, err)
+	}
+
+	saved := waitForSave(t, fake)
+	if saved.ID != job.ID || saved.Status != types.StatusSucceeded || !saved.Sent {
+		t.Errorf("saved job %+v, want job %s to have succeeded", saved, job.ID)
+	}
+	if saved.Response == nil || saved.Response.StatusCode != http.StatusOK {
+		t.Errorf("saved response %+v, want a 200", saved.Response)
+	}
+
+	if err := j.Stop(context.Background()); err != nil {
+		t.Errorf("Stop = %v", err)
+	}
+	if err := j.Stop(context.Background()); err != nil {
+		t.Errorf("second Stop = %v", err)
+	}
+}
+
+func TestJobStartLoadsPendingJobs(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	fake := newFakeDB()
+	job := &types.Job{TenantID: types.DefaultTenant, Queue: types.DefaultQueue, MaxRetries: 3, URI: target.URL, ExecuteAt: time.Now()}
+	if _, err := fake.CreateJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	j := newTestProcessor(t, fake)
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Stop(context.Background())
+
+	saved := waitForSave(t, fake)
+	if saved.ID != job.ID || saved.Status != types.StatusPending || saved.Try != 1 || saved.NextAttemptAt == nil {
+		t.Errorf("saved job %+v, want job %s to be retried", saved, job.ID)
+	}
+}
+
+func TestJobStopAbortsDeliveries(t *testing.T) {
+	started, done := make(chan struct{}), make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-done
+	}))
+	defer target.Close()
+	defer close(done)
+
+	fake := newFakeDB()
+	j := newTestProcessor(t, fake)
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &types.Job{URI: target.URL, ExecuteAt: time.Now()}
+	if _, err := j.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job was not sent")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := j.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Stop = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// aborted jobs are released for another instance, not saved
+	select {
+	case saved := <-fake.saved:
+		t.Errorf("saved aborted job %+v", saved)
+	default:
+	}
+	if fake.leased(job.ID) {
+		t.Errorf("job %s is still leased", job.ID)
+	}
+}
+
+func TestJobReservedWorkers(t *testing.T) {
+	fake := newFakeDB()
+	j, err := New(Config{Name: t.Name(), DB: fake, WorkerNum: 3, ReservedWorkers: 1, HighPriority: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := j.queues[types.DefaultQueue]
+	push := func(priority int) {
+		job := &types.Job{TenantID: types.DefaultTenant, Queue: types.DefaultQueue, Priority: priority, URI: "http://example.com", ExecuteAt: time.Now()}
+		if _, err := fake.CreateJob(job); err != nil {
+			t.Fatal(err)
+		}
+		q.pending.push(job, job.ExecuteAt)
+	}
+
+	// a busy worker leaves one idle worker for lower priority jobs
+	q.inFlight = 1
+	for i := 0; i < 3; i++ {
+		push(0)
+	}
+	due, saturated := j.dueJobs(q)
+	if len(due) != 1 || !saturated {
+		t.Fatalf("dueJobs claimed %d jobs, saturated %t, want 1 and saturated", len(due), saturated)
+	}
+
+	// the reserved worker is only given to high priority jobs
+	push(10)
+	due, _ = j.dueJobs(q)
+	if len(due) != 1 || due[0].Priority != 10 {
+		t.Fatalf("dueJobs claimed %v, want the high priority job", due)
+	}
+}
+
+func TestJobRefillSkipsPausedHosts(t *testing.T) {
+	fake := newFakeDB()
+	j, err := New(Config{Name: t.Name(), DB: fake, WorkerNum: 1, MaxLoadedJobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.pauses.Store(&pauseSet{queues: map[string]bool{}, hosts: []string{"*.paused.com"}})
+
+	// overdue jobs to a paused host do not fill the window
+	for i := 0; i < 3; i++ {
+		job := &types.Job{Queue: types.DefaultQueue, URI: "http://api.paused.com", ExecuteAt: time.Now().Add(-time.Hour)}
+		if _, err := fake.CreateJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := &types.Job{Queue: types.DefaultQueue, URI: "http://example.com", ExecuteAt: time.Now()}
+	if _, err := fake.CreateJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.refill(); err != nil {
+		t.Fatal(err)
+	}
+	if n := j.queues[types.DefaultQueue].pending.len(); n != 1 {
+		t.Errorf("scheduled %d jobs, want 1", n)
+	}
+}
+
+func TestJobRetriesConnectionErrors(t *testing.T) {
+	// nothing listens on a closed server's address
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.Close()
+
+	fake := newFakeDB()
+	j := newTestProcessor(t, fake)
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Stop(context.Background())
+
+	job := &types.Job{URI: target.URL, ExecuteAt: time.Now()}
+	if _, err := j.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := waitForSave(t, fake)
+	if saved.Status != types.StatusPending || saved.Try != 1 || saved.NextAttemptAt == nil {
+		t.Errorf("saved job %+v, want it to be retried", saved)
+	}
+}
+
+func TestJobFailsDeniedTargets(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the denied target was sent the job")
+	}))
+	defer target.Close()
+
+	policy, err := NewTargetPolicy(TargetPolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeDB()
+	j, err := New(Config{Name: t.Name(), DB: fake, WorkerNum: 1, MaxRetries: 3, Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Stop(context.Background())
+
+	// the loopback target was allowed when the job was created, the way a
+	// host rebound to an internal address is
+	job := &types.Job{URI: target.URL, ExecuteAt: time.Now()}
+	if _, err := j.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := waitForSave(t, fake)
+	if saved.Status != types.StatusFailed || saved.Try != -1 {
+		t.Errorf("saved job %+v, want it to have failed for good", saved)
+	}
+}
@@ -0,0 +1,158 @@
+package processors
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// limitDeferral is how long a job over a limit waits before it is tried again
+const limitDeferral = 250 * time.Millisecond
+
+// RateLimit limits concurrent deliveries and deliveries per second. Zero
+// values are unlimited.
+type RateLimit struct {
+	MaxConcurrent     int     `json:"max_concurrent"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+}
+
+// limiter enforces a RateLimit
+type limiter struct {
+	slots  chan struct{}
+	bucket *tokenBucket
+}
+
+func newLimiter(l RateLimit) *limiter {
+	lim := &limiter{}
+	if l.MaxConcurrent > 0 {
+		lim.slots = make(chan struct{}, l.MaxConcurrent)
+	}
+	if l.RequestsPerSecond > 0 {
+		lim.bucket = newTokenBucket(l.RequestsPerSecond)
+	}
+
+	return lim
+}
+
+// acquire takes a concurrency slot and a token if both are available
+func (l *limiter) acquire() bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	if l.bucket != nil && !l.bucket.Allow() {
+		l.release()
+		return false
+	}
+
+	return true
+}
+
+// release gives back a concurrency slot
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// refund gives back the token taken by acquire for a delivery that was not
+// made
+func (l *limiter) refund() {
+	if l.bucket != nil {
+		l.bucket.Refund()
+	}
+}
+
+// CheckRateLimitGroup returns an error if a rate limit group is not configured
+func (j *Job) CheckRateLimitGroup(name string) error {
+	if _, ok := j.groupLimiters[name]; !ok {
+		return fmt.Errorf("rate limit group %s does not exist", name)
+	}
+
+	return nil
+}
+
+// limiters returns the limiters of a job's host and rate limit group
+func (j *Job) limiters(job *types.Job) []*limiter {
+	limiters := []*limiter{j.queue(job).limiter}
+
+	host := jobHost(job)
+	if v, ok := j.hostLimiters.Load(host); ok {
+		limiters = append(limiters, v.(*limiter))
+	} else {
+		v, _ := j.hostLimiters.LoadOrStore(host, newLimiter(j.hostLimit(host)))
+		limiters = append(limiters, v.(*limiter))
+	}
+
+	if job.RateLimitGroup != nil {
+		if l, ok := j.groupLimiters[*job.RateLimitGroup]; ok {
+			limiters = append(limiters, l)
+		}
+	}
+
+	return limiters
+}
+
+// hostLimit returns the limit of the first host pattern matching host or the
+// global host limit
+func (j *Job) hostLimit(host string) RateLimit {
+	for _, pattern := range j.hostPatterns {
+		if matchHost([]string{pattern}, host) {
+			if limit := j.hosts[pattern].Limit; limit != nil {
+				return *limit
+			}
+			break
+		}
+	}
+
+	return j.Client.HostLimit
+}
+
+// acquireLimits takes a slot and a token from every limiter of a job or none
+// of them
+func (j *Job) acquireLimits(job *types.Job) bool {
+	limiters := j.limiters(job)
+	for i, l := range limiters {
+		if !l.acquire() {
+			for _, acquired := range limiters[:i] {
+				acquired.release()
+				acquired.refund()
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// releaseLimits gives back the slots taken by acquireLimits
+func (j *Job) releaseLimits(job *types.Job) {
+	for _, l := range j.limiters(job) {
+		l.release()
+	}
+}
+
+// refundLimits gives back the tokens taken by acquireLimits for a job that was
+// not sent so that it does not count against its host's or group's rate
+func (j *Job) refundLimits(job *types.Job) {
+	for _, l := range j.limiters(job) {
+		l.refund()
+	}
+}
+
+// jobHost returns the lowercased host a job is delivered to
+func jobHost(job *types.Job) string {
+	u, err := url.Parse(job.URI)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
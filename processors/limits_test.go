@@ -0,0 +1,49 @@
+package processors
+
+import (
+	"testing"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+func TestAcquireLimitsRefundsTokens(t *testing.T) {
+	fake := newFakeDB()
+	j, err := New(Config{
+		Name: t.Name(),
+		DB:   fake,
+		Client: ClientConfig{
+			HostLimit:       RateLimit{RequestsPerSecond: 2},
+			RateLimitGroups: map[string]RateLimit{"group": {MaxConcurrent: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := "group"
+	newJob := func() *types.Job {
+		return &types.Job{Queue: types.DefaultQueue, URI: "http://example.com", RateLimitGroup: &group}
+	}
+
+	first := newJob()
+	if !j.acquireLimits(first) {
+		t.Fatal("the first job was over the limits")
+	}
+
+	// the host's token is given back when the group is full
+	if j.acquireLimits(newJob()) {
+		t.Fatal("the second job was not over the group's limit")
+	}
+
+	// and when a job is not sent
+	j.releaseLimits(first)
+	j.refundLimits(first)
+
+	for i := 0; i < 2; i++ {
+		job := newJob()
+		if !j.acquireLimits(job) {
+			t.Fatalf("job %d was over the limits after the tokens were refunded", i)
+		}
+		j.releaseLimits(job)
+	}
+}
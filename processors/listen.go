@@ -0,0 +1,68 @@
+package processors
+
+import (
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+// jobsChannel is notified with a job's id whenever it is inserted or updated
+const jobsChannel = "jobs"
+
+// listen keeps the schedule in sync with jobs created or updated and scopes
+// paused or resumed by any instance
+func (j *Job) listen() error {
+	listener := pq.NewListener(j.ListenURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("jobs listener error: %s\n", err)
+		}
+	})
+
+	for _, channel := range []string{jobsChannel, pausesChannel} {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	j.listener = listener
+
+	go func() {
+		for n := range listener.Notify {
+			// a nil notification means the connection was re-established and
+			// notifications may have been missed
+			if n == nil || n.Channel == pausesChannel {
+				j.reloadPauses()
+				continue
+			}
+
+			id, err := uuid.FromString(n.Extra)
+			if err != nil {
+				log.Printf("invalid job notification %q\n", n.Extra)
+				continue
+			}
+
+			j.refresh(id)
+		}
+	}()
+
+	return nil
+}
+
+// refresh reloads a job after it changed. Jobs that are no longer pending,
+// e.g. because another instance sent them, are unscheduled.
+func (j *Job) refresh(id uuid.UUID) {
+	job, err := j.DB.GetPendingJob(id)
+	if err != nil {
+		log.Printf("error refreshing job %s: %s\n", id, err)
+		return
+	}
+
+	if job == nil {
+		j.unschedule(id.String())
+		return
+	}
+
+	j.schedule(job)
+}
@@ -0,0 +1,36 @@
+package processors
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// metrics are published with expvar under /admin/debug/vars keyed by processor name
+var (
+	inFlightJobs   = expvar.NewMap("processor_in_flight")
+	scheduledJobs  = expvar.NewMap("processor_scheduled")
+	queueSaturated = expvar.NewMap("processor_queue_saturated_total")
+	breakerStates  = expvar.NewMap("processor_circuit_breakers")
+	breakersOpened = expvar.NewMap("processor_circuit_breakers_opened_total")
+	expiredJobs    = expvar.NewMap("processor_expired_total")
+)
+
+func (j *Job) publishMetrics() {
+	inFlightJobs.Set(j.Name, expvar.Func(func() interface{} {
+		var inFlight int64
+		for _, q := range j.queues {
+			inFlight += atomic.LoadInt64(&q.inFlight)
+		}
+		return inFlight
+	}))
+	scheduledJobs.Set(j.Name, expvar.Func(func() interface{} {
+		scheduled := 0
+		for _, q := range j.queues {
+			scheduled += q.pending.len()
+		}
+		return scheduled
+	}))
+	breakerStates.Set(j.Name, expvar.Func(func() interface{} {
+		return j.CircuitBreakers()
+	}))
+}
@@ -0,0 +1,94 @@
+package processors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// notify posts a failed or expired job to its error URI. The notification is
+// sent once in the background and failures are only logged.
+func (j *Job) notify(job *types.Job) {
+	if (job.Status != types.StatusFailed && job.Status != types.StatusExpired) || job.ErrorURI == nil {
+		return
+	}
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("error encoding notification for job %s: %s\n", job.ID, err)
+		return
+	}
+
+	go func() {
+		if err := j.post(job.TenantID, *job.ErrorURI, body, nil); err != nil {
+			log.Printf("error notifying %s of job %s: %s\n", *job.ErrorURI, job.ID, err)
+		}
+	}()
+}
+
+// post sends a JSON body signed with the tenant's signing secret to uri
+// within the client timeout. Responses other than 2xx are errors.
+func (j *Job) post(tenantID, uri string, body []byte, header http.Header) error {
+	tenant, err := j.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), j.Client.Timeout.Duration)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature := tenant.sign(body); signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", uri, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// newResponse keeps the status, the stored headers and up to
+// Client.StoredResponseBytes of the body of a job's response
+func (j *Job) newResponse(resp *http.Response, body []byte) *types.Response {
+	r := &types.Response{
+		StatusCode: resp.StatusCode,
+		Headers:    map[string]string{},
+		ReceivedAt: time.Now(),
+	}
+
+	for _, name := range j.Client.StoredResponseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			r.Headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+
+	if int64(len(body)) > j.Client.StoredResponseBytes {
+		body = body[:j.Client.StoredResponseBytes]
+		r.Truncated = true
+	}
+	r.Body = string(body)
+
+	return r
+}
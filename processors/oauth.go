@@ -0,0 +1,151 @@
+package processors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// tokenExpiryDelta refreshes tokens this long before they expire
+const tokenExpiryDelta = 30 * time.Second
+
+// tokenError is returned when the access token of a job's credential cannot
+// be fetched. The job is retried since the token endpoint may recover.
+type tokenError struct {
+	Credential string
+	Err        error
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("error fetching token for credential %s: %s", e.Credential, e.Err)
+}
+
+type token struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// tokenSource fetches and caches the access token of one credential
+type tokenSource struct {
+	mu    sync.Mutex
+	token *token
+}
+
+// accessToken returns a cached access token for a tenant's credential,
+// fetching a new one when there is none or it is about to expire
+func (j *Job) accessToken(ctx context.Context, tenantID, name string) (string, error) {
+	v, _ := j.tokenSources.LoadOrStore(tenantID+"/"+name, &tokenSource{})
+	ts := v.(*tokenSource)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != nil && time.Now().Add(tokenExpiryDelta).Before(ts.token.expiresAt) {
+		return ts.token.accessToken, nil
+	}
+
+	t, err := j.fetchToken(ctx, tenantID, name)
+	if err != nil {
+		return "", err
+	}
+	ts.token = t
+
+	return t.accessToken, nil
+}
+
+// invalidateToken drops a cached token so the next request fetches a new one
+func (j *Job) invalidateToken(tenantID, name string) {
+	if v, ok := j.tokenSources.Load(tenantID + "/" + name); ok {
+		ts := v.(*tokenSource)
+		ts.mu.Lock()
+		ts.token = nil
+		ts.mu.Unlock()
+	}
+}
+
+// InvalidateCredential drops the cached token of a tenant's credential after
+// it was changed. Other instances keep using their token until it expires or
+// is rejected.
+func (j *Job) InvalidateCredential(tenantID, name string) {
+	j.invalidateToken(tenantID, name)
+}
+
+// fetchToken fetches a new access token for a tenant's credential. Errors
+// other than a missing credential are tokenErrors.
+func (j *Job) fetchToken(ctx context.Context, tenantID, name string) (*token, error) {
+	credential, err := j.DB.GetCredential(tenantID, name)
+	if err != nil {
+		return nil, &tokenError{Credential: name, Err: err}
+	}
+	if credential == nil {
+		return nil, fmt.Errorf("credential %s does not exist", name)
+	}
+
+	t, err := j.requestToken(ctx, credential)
+	if err != nil {
+		return nil, &tokenError{Credential: name, Err: err}
+	}
+
+	return t, nil
+}
+
+// requestToken requests an access token from a credential's token endpoint
+func (j *Job) requestToken(ctx context.Context, credential *types.Credential) (*token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(credential.Scopes) > 0 {
+		form.Set("scope", strings.Join(credential.Scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, credential.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(credential.ClientID), url.QueryEscape(credential.ClientSecret))
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, j.Client.MaxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error reading token: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("token endpoint returned no access_token")
+	}
+
+	// tokens without an expiry are refreshed hourly
+	expiresIn := time.Hour
+	if body.ExpiresIn > 0 {
+		expiresIn = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	return &token{accessToken: body.AccessToken, expiresAt: time.Now().Add(expiresIn)}, nil
+}
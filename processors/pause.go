@@ -0,0 +1,114 @@
+package processors
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// pausesChannel is notified whenever a scope is paused or resumed
+const pausesChannel = "pauses"
+
+// pauseSet is the paused scopes shared by every instance
+type pauseSet struct {
+	all    bool
+	queues map[string]bool
+	hosts  []string
+}
+
+// paused reports whether a job may not be delivered
+func (j *Job) paused(job *types.Job) bool {
+	set := j.pauses.Load().(*pauseSet)
+	return set.all || set.queues[j.queue(job).name] || matchHost(set.hosts, jobHost(job))
+}
+
+// pausedQueues returns the queues that are paused. It is never nil since a
+// nil array is NULL in postgres.
+func (j *Job) pausedQueues() []string {
+	queues := []string{}
+	for name, q := range j.queues {
+		if atomic.LoadInt32(&q.paused) == 1 {
+			queues = append(queues, name)
+		}
+	}
+
+	return queues
+}
+
+// pausedHosts returns the patterns of the paused hosts. It is never nil.
+func (j *Job) pausedHosts() []string {
+	return append([]string{}, j.pauses.Load().(*pauseSet).hosts...)
+}
+
+// loadPauses reloads the paused scopes from the db
+func (j *Job) loadPauses() error {
+	pauses, err := j.DB.GetPauses()
+	if err != nil {
+		return err
+	}
+
+	set := &pauseSet{queues: map[string]bool{}}
+	for _, p := range pauses {
+		switch p.Scope {
+		case types.PauseAll:
+			set.all = true
+		case types.PauseQueue:
+			set.queues[p.Target] = true
+		case types.PauseHost:
+			set.hosts = append(set.hosts, p.Target)
+		}
+	}
+	j.pauses.Store(set)
+
+	for name, q := range j.queues {
+		var paused int32
+		if set.all || set.queues[name] {
+			paused = 1
+		}
+		atomic.StoreInt32(&q.paused, paused)
+	}
+
+	return nil
+}
+
+// reloadPauses applies paused and resumed scopes. Resumed jobs were dropped
+// from the schedule so the window is loaded again.
+func (j *Job) reloadPauses() {
+	if err := j.loadPauses(); err != nil {
+		log.Printf("%s: error loading pauses: %s\n", j.Name, err)
+		return
+	}
+
+	if err := j.refill(); err != nil {
+		log.Printf("%s: error loading jobs: %s\n", j.Name, err)
+	}
+	j.wakeup()
+}
+
+// Pause stops delivering every job, a queue's jobs or the jobs to hosts
+// matching a pattern on every instance
+func (j *Job) Pause(p *types.Pause) error {
+	if err := j.DB.SavePause(p); err != nil {
+		return err
+	}
+	j.reloadPauses()
+
+	return nil
+}
+
+// Resume resumes a paused scope and reports whether it was paused
+func (j *Job) Resume(p *types.Pause) (bool, error) {
+	resumed, err := j.DB.DeletePause(p.Scope, p.Target)
+	if err != nil {
+		return false, err
+	}
+	j.reloadPauses()
+
+	return resumed, nil
+}
+
+// Pauses returns every paused scope
+func (j *Job) Pauses() ([]*types.Pause, error) {
+	return j.DB.GetPauses()
+}
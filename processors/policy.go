@@ -0,0 +1,306 @@
+package processors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// blockedCIDRs are the loopback, private, link-local and otherwise internal
+// ranges targets may not resolve to unless they are explicitly allowed. The
+// NAT64 and 6to4 ranges are blocked as a whole because they embed IPv4
+// addresses that gateways reach on the host's behalf.
+var blockedCIDRs = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// policyError is returned for targets the policy does not allow
+type policyError struct {
+	msg string
+}
+
+func (e *policyError) Error() string {
+	return e.msg
+}
+
+// TargetPolicyConfig lists the targets jobs may and may not be delivered to.
+// Hostnames match exactly or, when prefixed with "*.", any subdomain.
+type TargetPolicyConfig struct {
+	// Schemes defaults to http and https
+	Schemes []string `json:"schemes"`
+	// AllowCIDRs are internal ranges that targets may resolve to
+	AllowCIDRs []string `json:"allow_cidrs"`
+	// DenyCIDRs are ranges that targets may never resolve to
+	DenyCIDRs []string `json:"deny_cidrs"`
+	// AllowHosts are hosts that may resolve to internal ranges
+	AllowHosts []string `json:"allow_hosts"`
+	// DenyHosts are hosts that may never be targeted
+	DenyHosts []string `json:"deny_hosts"`
+	// AllowPrivate disables the internal range checks for dev environments
+	AllowPrivate bool `json:"allow_private"`
+}
+
+// TargetPolicy restricts the URIs jobs are delivered to. It is checked when a
+// job is created and again when a connection is dialed so that a host cannot
+// pass validation and later resolve to an internal address.
+type TargetPolicy struct {
+	schemes      map[string]bool
+	allowCIDRs   []*net.IPNet
+	denyCIDRs    []*net.IPNet
+	allowHosts   []string
+	denyHosts    []string
+	allowPrivate bool
+}
+
+// NewTargetPolicy builds a TargetPolicy from its config
+func NewTargetPolicy(cfg TargetPolicyConfig) (*TargetPolicy, error) {
+	p := &TargetPolicy{
+		schemes:      map[string]bool{},
+		allowHosts:   lowerAll(cfg.AllowHosts),
+		denyHosts:    lowerAll(cfg.DenyHosts),
+		allowPrivate: cfg.AllowPrivate,
+	}
+
+	schemes := cfg.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	for _, scheme := range schemes {
+		p.schemes[strings.ToLower(scheme)] = true
+	}
+
+	var err error
+	if p.allowCIDRs, err = parseCIDRs(cfg.AllowCIDRs...); err != nil {
+		return nil, err
+	}
+	if p.denyCIDRs, err = parseCIDRs(cfg.DenyCIDRs...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// CheckURI returns an error if the URI's scheme, host, or any address the host
+// currently resolves to is not allowed. A nil policy allows everything.
+func (p *TargetPolicy) CheckURI(uri string) error {
+	if p == nil {
+		return nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return &policyError{fmt.Sprintf("scheme %q is not allowed", u.Scheme)}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("uri %q has no host", uri)
+	}
+
+	if err := p.checkHost(host); err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(host, ip)
+	}
+
+	// hosts that do not resolve yet are checked again when dialed
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+
+	for _, ip := range ips {
+		if err := p.checkIP(host, ip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckHost resolves a host and returns an error if it or any address it
+// resolves to is not allowed. Unlike CheckURI it fails if the host does not
+// resolve. A nil policy allows everything.
+func (p *TargetPolicy) CheckHost(ctx context.Context, host string) error {
+	if p == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	if err := p.checkHost(host); err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(host, ip)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if err := p.checkIP(host, addr.IP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DialContext wraps dialer so that every address it connects to is checked
+// against the policy after DNS resolution. The trusted addresses, i.e.
+// proxies, are dialed without checks.
+func (p *TargetPolicy) DialContext(dialer *net.Dialer, trusted ...string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p == nil {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for _, t := range trusted {
+			if strings.EqualFold(t, addr) {
+				return dialer.DialContext(ctx, network, addr)
+			}
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		host = strings.ToLower(host)
+
+		if err := p.checkHost(host); err != nil {
+			return nil, err
+		}
+
+		d := *dialer
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if err := p.checkIP(host, net.ParseIP(ip)); err != nil {
+				return err
+			}
+
+			if dialer.Control != nil {
+				return dialer.Control(network, address, c)
+			}
+			return nil
+		}
+
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+func (p *TargetPolicy) checkHost(host string) error {
+	if matchHost(p.denyHosts, host) {
+		return &policyError{fmt.Sprintf("host %s is not allowed", host)}
+	}
+
+	return nil
+}
+
+func (p *TargetPolicy) checkIP(host string, ip net.IP) error {
+	if ip == nil {
+		return &policyError{fmt.Sprintf("host %s has an invalid address", host)}
+	}
+
+	if containsIP(p.denyCIDRs, ip) {
+		return &policyError{fmt.Sprintf("address %s of host %s is not allowed", ip, host)}
+	}
+
+	if p.allowPrivate || matchHost(p.allowHosts, host) || containsIP(p.allowCIDRs, ip) {
+		return nil
+	}
+
+	if containsIP(blockedCIDRs, ip) {
+		return &policyError{fmt.Sprintf("address %s of host %s is internal", ip, host)}
+	}
+
+	return nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if pattern == host {
+			return true
+		}
+
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+
+	return nets
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, v := range values {
+		lowered = append(lowered, strings.ToLower(strings.TrimSpace(v)))
+	}
+
+	return lowered
+}
@@ -0,0 +1,124 @@
+package processors
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{patterns: []string{"example.com"}, host: "example.com", want: true},
+		{patterns: []string{"example.com"}, host: "api.example.com"},
+		{patterns: []string{"*.example.com"}, host: "api.example.com", want: true},
+		{patterns: []string{"*.example.com"}, host: "a.b.example.com", want: true},
+		{patterns: []string{"*.example.com"}, host: "example.com"},
+		{patterns: []string{"*.example.com"}, host: "badexample.com"},
+		{patterns: []string{"*.example.com"}, host: "example.com.evil.org"},
+		{patterns: []string{"other.org", "*.example.com"}, host: "www.example.com", want: true},
+		{patterns: nil, host: "example.com"},
+	}
+
+	for _, test := range tests {
+		if got := matchHost(test.patterns, test.host); got != test.want {
+			t.Errorf("matchHost(%v, %q) = %t, want %t", test.patterns, test.host, got, test.want)
+		}
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	tests := []struct {
+		cfg     TargetPolicyConfig
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{host: "example.com", ip: "93.184.216.34", allowed: true},
+		{host: "example.com", ip: "2606:2800:220:1::248", allowed: true},
+		{host: "example.com", ip: "127.0.0.1"},
+		{host: "example.com", ip: "10.1.2.3"},
+		{host: "example.com", ip: "169.254.169.254"},
+		{host: "example.com", ip: "::1"},
+		{host: "example.com", ip: "fd00::1"},
+		// IPv4-mapped, NAT64 and 6to4 addresses of 169.254.169.254
+		{host: "example.com", ip: "::ffff:169.254.169.254"},
+		{host: "example.com", ip: "64:ff9b::a9fe:a9fe"},
+		{host: "example.com", ip: "64:ff9b:1::a9fe:a9fe"},
+		{host: "example.com", ip: "2002:a9fe:a9fe::1"},
+		{cfg: TargetPolicyConfig{AllowPrivate: true}, host: "example.com", ip: "10.1.2.3", allowed: true},
+		{cfg: TargetPolicyConfig{AllowHosts: []string{"*.internal"}}, host: "api.internal", ip: "10.1.2.3", allowed: true},
+		{cfg: TargetPolicyConfig{AllowCIDRs: []string{"10.1.0.0/16"}}, host: "example.com", ip: "10.1.2.3", allowed: true},
+		{cfg: TargetPolicyConfig{AllowCIDRs: []string{"10.1.0.0/16"}}, host: "example.com", ip: "10.2.2.3"},
+		// denied ranges win over everything that allows
+		{cfg: TargetPolicyConfig{AllowPrivate: true, DenyCIDRs: []string{"10.0.0.0/8"}}, host: "example.com", ip: "10.1.2.3"},
+		{cfg: TargetPolicyConfig{DenyCIDRs: []string{"93.184.216.0/24"}}, host: "example.com", ip: "93.184.216.34"},
+	}
+
+	for _, test := range tests {
+		p, err := NewTargetPolicy(test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.checkIP(test.host, net.ParseIP(test.ip))
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("checkIP(%q, %s) with %+v = %v, want allowed %t", test.host, test.ip, test.cfg, err, test.allowed)
+		}
+	}
+}
+
+func TestDialContextChecksResolvedAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// localhost passes the host checks and is only caught once it resolves,
+	// the way a host rebound to an internal address after validation is
+	p, err := NewTargetPolicy(TargetPolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := p.DialContext(&net.Dialer{})
+	_, err = dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	var policyErr *policyError
+	if !errors.As(err, &policyErr) || !strings.Contains(err.Error(), "is internal") {
+		t.Errorf("dialing localhost = %v, want an internal address error", err)
+	}
+
+	// trusted addresses such as proxies are dialed without checks
+	dial = p.DialContext(&net.Dialer{}, l.Addr().String())
+	c, err := dial(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing a trusted address = %v", err)
+	}
+	c.Close()
+
+	p, err = NewTargetPolicy(TargetPolicyConfig{AllowHosts: []string{"localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial = p.DialContext(&net.Dialer{})
+	c, err = dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("dialing an allowed host = %v", err)
+	}
+	c.Close()
+}
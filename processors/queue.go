@@ -0,0 +1,121 @@
+package processors
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// QueueConfig configures a named queue. Zero values fall back to the
+// processor's config.
+type QueueConfig struct {
+	// WorkerNum is how many jobs of the queue are delivered at once
+	WorkerNum int `json:"worker_num"`
+	// MaxRetries is the number of tries the queue's jobs get unless their
+	// tenant sets its own
+	MaxRetries int `json:"max_retries"`
+	// RetryBackoff is the delay before the first retry. It doubles with every
+	// try. Defaults to 5s.
+	RetryBackoff types.Duration `json:"retry_backoff"`
+	// Limit limits the deliveries of every job in the queue
+	Limit RateLimit `json:"limit"`
+}
+
+// queue is a named queue with its own schedule and worker pool
+type queue struct {
+	QueueConfig
+	name    string
+	pending *schedule
+	limiter *limiter
+	// inFlight counts the queue's jobs claimed and not yet saved
+	inFlight int64
+	// paused is set while the queue or every queue is paused
+	paused int32
+	jobs   chan *types.Job
+}
+
+func newQueue(name string, cfg QueueConfig, wake chan struct{}) *queue {
+	return &queue{
+		QueueConfig: cfg,
+		name:        name,
+		pending:     newSchedule(wake),
+		limiter:     newLimiter(cfg.Limit),
+	}
+}
+
+// newQueues builds the processor's queues. The default queue always exists
+// and uses WorkerNum and MaxRetries unless it is configured.
+func (j *Job) newQueues() {
+	j.queues = map[string]*queue{}
+	if _, ok := j.Queues[types.DefaultQueue]; !ok {
+		j.queues[types.DefaultQueue] = newQueue(types.DefaultQueue, j.queueDefaults(QueueConfig{}), j.wake)
+	}
+
+	for name, cfg := range j.Queues {
+		j.queues[name] = newQueue(name, j.queueDefaults(cfg), j.wake)
+	}
+}
+
+func (j *Job) queueDefaults(cfg QueueConfig) QueueConfig {
+	if cfg.WorkerNum == 0 {
+		cfg.WorkerNum = j.WorkerNum
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = j.MaxRetries
+	}
+	if cfg.RetryBackoff.Duration == 0 {
+		cfg.RetryBackoff.Duration = 5 * time.Second
+	}
+
+	return cfg
+}
+
+// queue returns a job's queue. Jobs in queues this processor does not have,
+// e.g. because they were created by an instance with another config, go to
+// the default queue.
+func (j *Job) queue(job *types.Job) *queue {
+	if q, ok := j.queues[job.Queue]; ok {
+		return q
+	}
+
+	return j.queues[types.DefaultQueue]
+}
+
+// CheckQueue returns an error if a queue is not configured
+func (j *Job) CheckQueue(name string) error {
+	if _, ok := j.queues[name]; !ok {
+		return fmt.Errorf("queue %s does not exist", name)
+	}
+
+	return nil
+}
+
+// QueueStats returns the queues with their depth and in flight counts
+func (j *Job) QueueStats() ([]types.Queue, error) {
+	depths, err := j.DB.CountPendingJobsByQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make([]types.Queue, 0, len(j.queues))
+	for name, q := range j.queues {
+		queues = append(queues, types.Queue{
+			Name:       name,
+			WorkerNum:  q.WorkerNum,
+			MaxRetries: q.MaxRetries,
+			Paused:     atomic.LoadInt32(&q.paused) == 1,
+			Depth:      depths[name],
+			Scheduled:  q.pending.len(),
+			InFlight:   atomic.LoadInt64(&q.inFlight),
+		})
+	}
+
+	sort.Slice(queues, func(a, b int) bool {
+		return queues[a].Name < queues[b].Name
+	})
+
+	return queues, nil
+}
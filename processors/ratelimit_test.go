@@ -0,0 +1,68 @@
+package processors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2)
+
+	// a full bucket allows a burst of rate tokens
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("token %d was not allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("token over the burst was allowed")
+	}
+
+	// a refunded token can be taken again
+	b.Refund()
+	if !b.Allow() {
+		t.Fatal("refunded token was not allowed")
+	}
+
+	// tokens are refilled at rate per second
+	b.mu.Lock()
+	b.last = b.last.Add(-500 * time.Millisecond)
+	b.mu.Unlock()
+	if !b.Allow() {
+		t.Fatal("refilled token was not allowed")
+	}
+	if b.Allow() {
+		t.Fatal("token over the refill was allowed")
+	}
+
+	// refills and refunds stop at the burst
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+	b.Refund()
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("token %d was not allowed after a refill", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("token over the burst was allowed after a refill")
+	}
+}
+
+func TestTokenBucketFractionalRate(t *testing.T) {
+	b := newTokenBucket(0.5)
+	if !b.Allow() {
+		t.Fatal("first token was not allowed")
+	}
+	if b.Allow() {
+		t.Fatal("second token was allowed")
+	}
+
+	b.mu.Lock()
+	b.last = b.last.Add(-2 * time.Second)
+	b.mu.Unlock()
+	if !b.Allow() {
+		t.Fatal("token was not refilled after 2s")
+	}
+}
@@ -0,0 +1,73 @@
+package processors
+
+import (
+	"log"
+	"time"
+
+	"github.com/cbelsole/dsw/db"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Reencrypt is a processor that re-encrypts rows under the current key after a
+// key rotation
+type Reencrypt struct {
+	DB        *db.DB
+	Interval  time.Duration
+	BatchSize int
+}
+
+// Start re-encrypts rows in batches every interval
+func (r *Reencrypt) Start() {
+	go func() {
+		for range time.Tick(r.Interval) {
+			r.run()
+		}
+	}()
+}
+
+// run pages through every table once. Rows that cannot be decrypted are
+// skipped by the DB and left behind by the page, so they do not stop the rows
+// after them from being re-encrypted.
+func (r *Reencrypt) run() {
+	var jobsAfter uuid.UUID
+	r.batches("jobs", func() (bool, int, error) {
+		last, count, err := r.DB.ReencryptJobs(jobsAfter, r.BatchSize)
+		jobsAfter = last
+		return last != uuid.Nil, count, err
+	})
+
+	var credentialsAfter db.CredentialKey
+	r.batches("credentials", func() (bool, int, error) {
+		last, count, err := r.DB.ReencryptCredentials(credentialsAfter, r.BatchSize)
+		if last != nil {
+			credentialsAfter = *last
+		}
+		return last != nil, count, err
+	})
+
+	var callbacksAfter uuid.UUID
+	r.batches("callbacks", func() (bool, int, error) {
+		last, count, err := r.DB.ReencryptCallbacks(callbacksAfter, r.BatchSize)
+		callbacksAfter = last
+		return last != uuid.Nil, count, err
+	})
+}
+
+// batches calls batch until it reports that there are no rows left
+func (r *Reencrypt) batches(name string, batch func() (bool, int, error)) {
+	for {
+		more, count, err := batch()
+		if err != nil {
+			log.Printf("error re-encrypting %s: %s\n", name, err)
+			return
+		}
+
+		if count > 0 {
+			log.Printf("re-encrypted %d %s\n", count, name)
+		}
+
+		if !more {
+			return
+		}
+	}
+}
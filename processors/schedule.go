@@ -0,0 +1,186 @@
+package processors
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// scheduled is a job waiting in the schedule until at
+type scheduled struct {
+	job   *types.Job
+	at    time.Time
+	index int
+	// ready is set once the job is due and has moved to the ready heap
+	ready bool
+}
+
+// scheduledHeap is a heap of scheduled jobs ordered by less
+type scheduledHeap struct {
+	entries []*scheduled
+	less    func(a, b *scheduled) bool
+}
+
+func (h *scheduledHeap) Len() int           { return len(h.entries) }
+func (h *scheduledHeap) Less(a, b int) bool { return h.less(h.entries[a], h.entries[b]) }
+func (h *scheduledHeap) Swap(a, b int) {
+	h.entries[a], h.entries[b] = h.entries[b], h.entries[a]
+	h.entries[a].index = a
+	h.entries[b].index = b
+}
+
+func (h *scheduledHeap) Push(x interface{}) {
+	s := x.(*scheduled)
+	s.index = len(h.entries)
+	h.entries = append(h.entries, s)
+}
+
+func (h *scheduledHeap) Pop() interface{} {
+	old := h.entries
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.entries = old[:len(old)-1]
+	s.index = -1
+	return s
+}
+
+// schedule holds the jobs waiting to be dispatched. Jobs wait in a heap
+// ordered by when they are due and move to a heap ordered by priority, then
+// when they are due, once they are due. Jobs are removed while they are
+// processing and pushed back if they need to be retried.
+type schedule struct {
+	mu      sync.Mutex
+	waiting *scheduledHeap
+	ready   *scheduledHeap
+	byID    map[string]*scheduled
+	wake    chan struct{}
+}
+
+func newSchedule(wake chan struct{}) *schedule {
+	return &schedule{
+		waiting: &scheduledHeap{less: func(a, b *scheduled) bool {
+			return a.at.Before(b.at)
+		}},
+		ready: &scheduledHeap{less: func(a, b *scheduled) bool {
+			if a.job.Priority != b.job.Priority {
+				return a.job.Priority > b.job.Priority
+			}
+			return a.at.Before(b.at)
+		}},
+		byID: map[string]*scheduled{},
+		wake: wake,
+	}
+}
+
+// push schedules a job at a time, rescheduling it if it is already scheduled.
+// The dispatcher is woken if the job is now the next one due.
+func (s *schedule) push(job *types.Job, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := job.ID.String()
+	entry, ok := s.byID[id]
+	if ok {
+		heap.Remove(s.heapOf(entry), entry.index)
+		entry.job = job
+		entry.at = at
+		entry.ready = false
+	} else {
+		entry = &scheduled{job: job, at: at}
+		s.byID[id] = entry
+	}
+	heap.Push(s.waiting, entry)
+
+	if entry.index == 0 {
+		s.wakeup()
+	}
+}
+
+// remove unschedules a job
+func (s *schedule) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.byID[id]; ok {
+		heap.Remove(s.heapOf(entry), entry.index)
+		delete(s.byID, id)
+	}
+}
+
+// popDue removes and returns up to max jobs due at or before now, highest
+// priority first. Jobs with a priority below highPriority only get up to
+// maxLow of them. more reports whether due jobs were left on the schedule.
+func (s *schedule) popDue(now time.Time, max, maxLow, highPriority int) (due []*types.Job, more bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.waiting.Len() > 0 && !s.waiting.entries[0].at.After(now) {
+		entry := heap.Pop(s.waiting).(*scheduled)
+		entry.ready = true
+		heap.Push(s.ready, entry)
+	}
+
+	low := 0
+	for s.ready.Len() > 0 {
+		// the ready heap is ordered by priority so only low priority jobs
+		// are left once one does not fit
+		head := s.ready.entries[0]
+		if len(due) == max || (head.job.Priority < highPriority && low >= maxLow) {
+			return due, true
+		}
+		if head.job.Priority < highPriority {
+			low++
+		}
+
+		entry := heap.Pop(s.ready).(*scheduled)
+		delete(s.byID, entry.job.ID.String())
+		due = append(due, entry.job)
+	}
+
+	return due, false
+}
+
+func (s *schedule) heapOf(entry *scheduled) *scheduledHeap {
+	if entry.ready {
+		return s.ready
+	}
+
+	return s.waiting
+}
+
+// next returns how long until the next job is due, up to max
+func (s *schedule) next(now time.Time, max time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ready.Len() > 0 {
+		return 0
+	}
+
+	if s.waiting.Len() == 0 {
+		return max
+	}
+
+	if until := s.waiting.entries[0].at.Sub(now); until < max {
+		return until
+	}
+
+	return max
+}
+
+// len returns the number of scheduled jobs
+func (s *schedule) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.waiting.Len() + s.ready.Len()
+}
+
+func (s *schedule) wakeup() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,102 @@
+package processors
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+	uuid "github.com/satori/go.uuid"
+)
+
+// pendingJobs is the number of jobs the benchmarks schedule
+const pendingJobs = 1000000
+
+func newScheduledJobs(n int, now time.Time) ([]*types.Job, []time.Time) {
+	r := rand.New(rand.NewSource(1))
+	jobs := make([]*types.Job, n)
+	ats := make([]time.Time, n)
+	for i := range jobs {
+		jobs[i] = &types.Job{ID: uuid.NewV4(), Priority: r.Intn(3)}
+		ats[i] = now.Add(time.Duration(r.Int63n(int64(time.Hour))))
+	}
+
+	return jobs, ats
+}
+
+func TestSchedulePopDue(t *testing.T) {
+	now := time.Now()
+	s := newSchedule(make(chan struct{}, 1))
+
+	low := &types.Job{ID: uuid.NewV4()}
+	high := &types.Job{ID: uuid.NewV4(), Priority: 10}
+	later := &types.Job{ID: uuid.NewV4(), Priority: 10}
+	s.push(low, now.Add(-time.Minute))
+	s.push(high, now)
+	s.push(later, now.Add(time.Minute))
+
+	if got := s.next(now, time.Hour); got > 0 {
+		t.Errorf("next = %s, want a job to be due", got)
+	}
+
+	// high priority jobs are popped first and low ones only up to maxLow
+	due, more := s.popDue(now, 2, 0, 5)
+	if len(due) != 1 || due[0] != high || !more {
+		t.Fatalf("popDue = %v, %t, want the high priority job and more", due, more)
+	}
+
+	due, more = s.popDue(now, 2, 1, 5)
+	if len(due) != 1 || due[0] != low || more {
+		t.Fatalf("popDue = %v, %t, want the low priority job", due, more)
+	}
+
+	if got := s.next(now, time.Hour); got != time.Minute {
+		t.Errorf("next = %s, want 1m", got)
+	}
+
+	// rescheduling a job moves it
+	s.push(later, now.Add(-time.Second))
+	if due, _ := s.popDue(now, 10, 10, 5); len(due) != 1 || due[0] != later {
+		t.Fatalf("popDue = %v, want the rescheduled job", due)
+	}
+	if s.len() != 0 {
+		t.Errorf("len = %d, want 0", s.len())
+	}
+}
+
+// BenchmarkSchedulePush pushes jobs onto a schedule holding pendingJobs jobs
+func BenchmarkSchedulePush(b *testing.B) {
+	now := time.Now()
+	s := newSchedule(make(chan struct{}, 1))
+	jobs, ats := newScheduledJobs(pendingJobs, now)
+	for i, job := range jobs {
+		s.push(job, ats[i])
+	}
+
+	extra, extraAts := newScheduledJobs(b.N, now)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.push(extra[i], extraAts[i])
+	}
+}
+
+// BenchmarkSchedulePopDue pops batches of 100 due jobs from a schedule
+// holding pendingJobs jobs, pushing them back so the schedule stays full
+func BenchmarkSchedulePopDue(b *testing.B) {
+	now := time.Now()
+	s := newSchedule(make(chan struct{}, 1))
+	jobs, ats := newScheduledJobs(pendingJobs, now)
+	for i, job := range jobs {
+		s.push(job, ats[i])
+	}
+
+	const batch = 100
+	popAt := now.Add(time.Hour)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		due, _ := s.popDue(popAt, batch, batch, 1)
+		for _, job := range due {
+			s.push(job, now.Add(time.Duration(i)))
+		}
+	}
+}
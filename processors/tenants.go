@@ -0,0 +1,77 @@
+package processors
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// tenantTTL is how long a tenant's settings are cached before being reloaded
+const tenantTTL = time.Minute
+
+// SignatureHeader carries the HMAC-SHA256 of the request body when the job's
+// tenant has a signing secret
+const SignatureHeader = "X-DSW-Signature"
+
+type tenantEntry struct {
+	tenant   *types.Tenant
+	limiter  *tokenBucket
+	loadedAt time.Time
+}
+
+// tenant returns the cached settings for a tenant, reloading them from the
+// db once they are older than tenantTTL
+func (j *Job) tenant(id string) (*tenantEntry, error) {
+	if v, ok := j.tenants.Load(id); ok {
+		entry := v.(*tenantEntry)
+		if time.Since(entry.loadedAt) < tenantTTL {
+			return entry, nil
+		}
+	}
+
+	t, err := j.DB.GetTenant(id)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &tenantEntry{tenant: t, loadedAt: time.Now()}
+	if t.DeliveryRate != nil {
+		entry.limiter = newTokenBucket(*t.DeliveryRate)
+		// keep the bucket's state across reloads if the rate did not change
+		if v, ok := j.tenants.Load(id); ok {
+			if old := v.(*tenantEntry); old.limiter != nil && old.limiter.rate == *t.DeliveryRate {
+				entry.limiter = old.limiter
+			}
+		}
+	}
+	j.tenants.Store(id, entry)
+
+	return entry, nil
+}
+
+// allow reports whether the tenant's delivery rate permits another delivery
+func (e *tenantEntry) allow() bool {
+	return e.limiter == nil || e.limiter.Allow()
+}
+
+// refund gives back the delivery taken by allow for a job that was deferred
+func (e *tenantEntry) refund() {
+	if e.limiter != nil {
+		e.limiter.Refund()
+	}
+}
+
+// sign returns the signature of body using the tenant's signing secret or an
+// empty string if the tenant does not have one
+func (e *tenantEntry) sign(body []byte) string {
+	if e.tenant.SigningSecret == nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(*e.tenant.SigningSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,113 @@
+package processors
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// TLSConfig configures the client certificate, extra root CAs, and
+// certificate pins used when delivering to HTTPS targets
+type TLSConfig struct {
+	// CertFile and KeyFile are a PEM encoded client certificate and key
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// RootCAFiles are PEM encoded CAs trusted in addition to the system roots
+	RootCAFiles []string `json:"root_ca_files"`
+	// Pins are base64 encoded SHA-256 hashes of a certificate's public key.
+	// When set, one of the certificates in the verified chain from the
+	// target's certificate to a trusted root must match.
+	Pins []string `json:"pins"`
+}
+
+// HostConfig overrides the client config for targets matching a host pattern
+type HostConfig struct {
+	// TLS replaces the global TLS config for the host
+	TLS *TLSConfig `json:"tls"`
+	// Limit replaces the global host limit for the host
+	Limit *RateLimit `json:"limit"`
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.RootCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, filename := range c.RootCAFiles {
+			pem, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read root CA: %s", err)
+			}
+
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", filename)
+			}
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(c.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range c.Pins {
+			pins[strings.TrimSpace(pin)] = true
+		}
+
+		// only verified chains count since a target can present any extra
+		// certificates it likes, including ones with a pinned key
+		cfg.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+						return nil
+					}
+				}
+			}
+
+			return errors.New("no certificate matched a pinned key")
+		}
+	}
+
+	return cfg, nil
+}
+
+// hostRoundTripper sends requests with the transport of the first host
+// pattern matching the request's host, or the default transport
+type hostRoundTripper struct {
+	patterns   []string
+	transports []http.RoundTripper
+	fallback   http.RoundTripper
+}
+
+func (h *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	for i, pattern := range h.patterns {
+		if matchHost([]string{pattern}, host) {
+			return h.transports[i].RoundTrip(req)
+		}
+	}
+
+	return h.fallback.RoundTrip(req)
+}
@@ -0,0 +1,51 @@
+package processors
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cbelsole/dsw/types"
+)
+
+// schedule adds a job to the schedule unless it is not pending, processing,
+// paused or due after the loaded window. Jobs due later stay in the db until the window
+// rolls forward.
+func (j *Job) schedule(job *types.Job) {
+	if !job.Pending() || job.DueAt().UnixNano() > atomic.LoadInt64(&j.loadedUntil) || j.paused(job) {
+		j.unschedule(job.ID.String())
+		return
+	}
+
+	if _, processing := j.processingJobs.Load(job.ID.String()); !processing {
+		j.queue(job).pending.push(job, job.DueAt())
+	}
+}
+
+// unschedule removes a job from every queue's schedule
+func (j *Job) unschedule(id string) {
+	for _, q := range j.queues {
+		q.pending.remove(id)
+	}
+}
+
+// refill rolls the window forward and loads the jobs due within it. If more
+// than MaxLoadedJobs are due the window ends at the last job loaded.
+func (j *Job) refill() error {
+	until := time.Now().Add(j.Window)
+	// paused jobs are left out so they cannot fill the window
+	loadedJobs, err := j.DB.GetPendingJobs(until, j.MaxLoadedJobs, j.pausedQueues(), j.pausedHosts())
+	if err != nil {
+		return err
+	}
+
+	if len(loadedJobs) == j.MaxLoadedJobs {
+		until = loadedJobs[len(loadedJobs)-1].DueAt()
+	}
+	atomic.StoreInt64(&j.loadedUntil, until.UnixNano())
+
+	for _, job := range loadedJobs {
+		j.schedule(job)
+	}
+
+	return nil
+}
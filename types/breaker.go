@@ -0,0 +1,11 @@
+package types
+
+import "time"
+
+// CircuitBreaker is the state of the circuit breaker guarding a target host
+type CircuitBreaker struct {
+	Host     string     `json:"host"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at"`
+}
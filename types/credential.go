@@ -0,0 +1,16 @@
+package types
+
+import "time"
+
+// Credential is an OAuth2 client credentials grant used to authenticate a
+// job's requests
+type Credential struct {
+	TenantID     string    `json:"tenant_id"`
+	Name         string    `json:"name"`
+	TokenURL     string    `json:"token_url"`
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"-"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
@@ -0,0 +1,193 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// delivery outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeRetry   = "retry"
+	OutcomeFatal   = "fatal"
+)
+
+// SuccessCriteria decides whether a response means a job succeeded, should be
+// retried or failed. Status codes are exact codes such as "409", ranges such
+// as "200-204" or classes such as "4xx". By default 2xx succeed, 5xx are
+// retried and every other code fails.
+type SuccessCriteria struct {
+	SuccessCodes []string `json:"success_codes"`
+	RetryCodes   []string `json:"retry_codes"`
+	FatalCodes   []string `json:"fatal_codes"`
+	// BodyPath is a path such as "$.ok" that has to exist in a successful
+	// JSON response body and, if BodyEquals is set, equal it
+	BodyPath   string      `json:"body_path"`
+	BodyEquals interface{} `json:"body_equals"`
+	// BodyRegex has to match a successful response body
+	BodyRegex string `json:"body_regex"`
+	// BodyMismatch is the outcome of a successful status code whose body does
+	// not match, retry or fatal. Defaults to fatal.
+	BodyMismatch string `json:"body_mismatch"`
+}
+
+// codeRange is a parsed status code pattern
+type codeRange struct {
+	lo, hi int
+}
+
+func parseCodeRange(pattern string) (codeRange, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if len(pattern) == 3 && strings.HasSuffix(pattern, "xx") {
+		class, err := strconv.Atoi(pattern[:1])
+		if err == nil && class >= 1 && class <= 5 {
+			return codeRange{class * 100, class*100 + 99}, nil
+		}
+	} else if parts := strings.SplitN(pattern, "-", 2); len(parts) == 2 {
+		lo, errLo := strconv.Atoi(parts[0])
+		hi, errHi := strconv.Atoi(parts[1])
+		if errLo == nil && errHi == nil && lo >= 100 && lo <= hi && hi <= 599 {
+			return codeRange{lo, hi}, nil
+		}
+	} else if code, err := strconv.Atoi(pattern); err == nil && code >= 100 && code <= 599 {
+		return codeRange{code, code}, nil
+	}
+
+	return codeRange{}, fmt.Errorf("invalid status code pattern %q", pattern)
+}
+
+// Validate returns an error if a pattern, the body regex or the body mismatch
+// outcome is invalid
+func (c *SuccessCriteria) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	for _, patterns := range [][]string{c.SuccessCodes, c.RetryCodes, c.FatalCodes} {
+		for _, pattern := range patterns {
+			if _, err := parseCodeRange(pattern); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.BodyRegex != "" {
+		if _, err := regexp.Compile(c.BodyRegex); err != nil {
+			return fmt.Errorf("invalid body_regex: %s", err)
+		}
+	}
+
+	if c.BodyMismatch != "" && c.BodyMismatch != OutcomeRetry && c.BodyMismatch != OutcomeFatal {
+		return fmt.Errorf("body_mismatch must be %s or %s", OutcomeRetry, OutcomeFatal)
+	}
+
+	if c.BodyEquals != nil && c.BodyPath == "" {
+		return errors.New("body_equals requires body_path")
+	}
+
+	return nil
+}
+
+// Classify returns the outcome of a response and, unless it succeeded, why.
+// A nil SuccessCriteria uses the defaults.
+func (c *SuccessCriteria) Classify(status int, body []byte) (string, error) {
+	outcome := defaultOutcome(status)
+	if c == nil {
+		return outcome, outcomeError(outcome, status, body)
+	}
+
+	// the defaults are 2xx, 5xx and every other code. The narrowest matching
+	// pattern wins and ties go to the job's patterns.
+	width := 100
+	if outcome == OutcomeFatal {
+		width = 1000
+	}
+	for _, rule := range []struct {
+		outcome  string
+		patterns []string
+	}{
+		{OutcomeSuccess, c.SuccessCodes},
+		{OutcomeRetry, c.RetryCodes},
+		{OutcomeFatal, c.FatalCodes},
+	} {
+		for _, pattern := range rule.patterns {
+			r, err := parseCodeRange(pattern)
+			if err != nil || status < r.lo || status > r.hi {
+				continue
+			}
+			if w := r.hi - r.lo + 1; w <= width {
+				width = w
+				outcome = rule.outcome
+			}
+		}
+	}
+
+	if outcome != OutcomeSuccess {
+		return outcome, outcomeError(outcome, status, body)
+	}
+
+	if err := c.matchBody(body); err != nil {
+		if c.BodyMismatch == OutcomeRetry {
+			return OutcomeRetry, err
+		}
+		return OutcomeFatal, err
+	}
+
+	return OutcomeSuccess, nil
+}
+
+// matchBody returns an error if the body does not match the body assertions
+func (c *SuccessCriteria) matchBody(body []byte) error {
+	if c.BodyRegex != "" {
+		re, err := regexp.Compile(c.BodyRegex)
+		if err != nil {
+			return err
+		}
+		if !re.Match(body) {
+			return fmt.Errorf("response body did not match %s: %s", c.BodyRegex, string(body))
+		}
+	}
+
+	if c.BodyPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("response body is not JSON: %s", string(body))
+		}
+
+		v, ok := LookupPath(doc, c.BodyPath)
+		if !ok {
+			return fmt.Errorf("response body has no %s: %s", c.BodyPath, string(body))
+		}
+
+		if c.BodyEquals != nil && !reflect.DeepEqual(v, c.BodyEquals) {
+			return fmt.Errorf("response body %s is %v, not %v", c.BodyPath, v, c.BodyEquals)
+		}
+	}
+
+	return nil
+}
+
+func defaultOutcome(status int) string {
+	switch {
+	case status >= 200 && status <= 299:
+		return OutcomeSuccess
+	case status >= 500 && status <= 599:
+		return OutcomeRetry
+	default:
+		return OutcomeFatal
+	}
+}
+
+func outcomeError(outcome string, status int, body []byte) error {
+	if outcome == OutcomeSuccess {
+		return nil
+	}
+
+	return fmt.Errorf("URI returned %d: %s", status, string(body))
+}
@@ -0,0 +1,134 @@
+package types
+
+import "testing"
+
+func TestParseCodeRange(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    codeRange
+		wantErr bool
+	}{
+		{pattern: "409", want: codeRange{409, 409}},
+		{pattern: " 200-204 ", want: codeRange{200, 204}},
+		{pattern: "4xx", want: codeRange{400, 499}},
+		{pattern: "5XX", want: codeRange{500, 599}},
+		{pattern: "0xx", wantErr: true},
+		{pattern: "6xx", wantErr: true},
+		{pattern: "204-200", wantErr: true},
+		{pattern: "99", wantErr: true},
+		{pattern: "600", wantErr: true},
+		{pattern: "200-600", wantErr: true},
+		{pattern: "abc", wantErr: true},
+		{pattern: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseCodeRange(test.pattern)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseCodeRange(%q) = %v, want an error", test.pattern, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseCodeRange(%q) = %v, %v, want %v", test.pattern, got, err, test.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria *SuccessCriteria
+		status   int
+		body     string
+		want     string
+	}{
+		{name: "default 2xx", status: 204, want: OutcomeSuccess},
+		{name: "default 3xx", status: 302, want: OutcomeFatal},
+		{name: "default 4xx", status: 404, want: OutcomeFatal},
+		{name: "default 5xx", status: 503, want: OutcomeRetry},
+		{name: "empty criteria", criteria: &SuccessCriteria{}, status: 500, want: OutcomeRetry},
+		{
+			name:     "exact code",
+			criteria: &SuccessCriteria{SuccessCodes: []string{"409"}},
+			status:   409,
+			want:     OutcomeSuccess,
+		},
+		{
+			name:     "class retries",
+			criteria: &SuccessCriteria{RetryCodes: []string{"4xx"}},
+			status:   429,
+			want:     OutcomeRetry,
+		},
+		{
+			name:     "ties go to the job's patterns",
+			criteria: &SuccessCriteria{RetryCodes: []string{"2xx"}},
+			status:   200,
+			want:     OutcomeRetry,
+		},
+		{
+			name:     "narrowest pattern wins",
+			criteria: &SuccessCriteria{RetryCodes: []string{"4xx"}, FatalCodes: []string{"400-404"}},
+			status:   403,
+			want:     OutcomeFatal,
+		},
+		{
+			name:     "narrowest pattern wins outside the range",
+			criteria: &SuccessCriteria{RetryCodes: []string{"4xx"}, FatalCodes: []string{"400-404"}},
+			status:   429,
+			want:     OutcomeRetry,
+		},
+		{
+			name:     "fatal 5xx",
+			criteria: &SuccessCriteria{FatalCodes: []string{"501"}},
+			status:   501,
+			want:     OutcomeFatal,
+		},
+		{
+			name:     "body path",
+			criteria: &SuccessCriteria{BodyPath: "$.ok", BodyEquals: true},
+			status:   200,
+			body:     `{"ok": true}`,
+			want:     OutcomeSuccess,
+		},
+		{
+			name:     "body path mismatch",
+			criteria: &SuccessCriteria{BodyPath: "$.ok", BodyEquals: true},
+			status:   200,
+			body:     `{"ok": false}`,
+			want:     OutcomeFatal,
+		},
+		{
+			name:     "body not JSON",
+			criteria: &SuccessCriteria{BodyPath: "$.ok"},
+			status:   200,
+			body:     `ok`,
+			want:     OutcomeFatal,
+		},
+		{
+			name:     "body regex mismatch retries",
+			criteria: &SuccessCriteria{BodyRegex: "^done$", BodyMismatch: OutcomeRetry},
+			status:   200,
+			body:     "pending",
+			want:     OutcomeRetry,
+		},
+		{
+			name:     "body is not checked on failure",
+			criteria: &SuccessCriteria{BodyRegex: "^done$", BodyMismatch: OutcomeRetry},
+			status:   400,
+			body:     "done",
+			want:     OutcomeFatal,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.criteria.Classify(test.status, []byte(test.body))
+		if got != test.want {
+			t.Errorf("%s: Classify(%d) = %s, want %s", test.name, test.status, got, test.want)
+		}
+		if (err == nil) != (got == OutcomeSuccess) {
+			t.Errorf("%s: Classify(%d) returned %s with error %v", test.name, test.status, got, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration that is marshalled to and from JSON as a string
+// like "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
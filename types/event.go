@@ -0,0 +1,79 @@
+package types
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// job events
+const (
+	EventSucceeded = "job.succeeded"
+	EventFailed    = "job.failed"
+	// EventRetrying is sent when a delivery failed and the job will be retried
+	EventRetrying  = "job.retrying"
+	EventCancelled = "job.cancelled"
+	EventExpired   = "job.expired"
+)
+
+// job events that are only streamed, not sent to callback URIs
+const (
+	EventCreated    = "job.created"
+	EventDispatched = "job.dispatched"
+)
+
+// Events are every event a job's callback URI can be sent
+var Events = []string{EventSucceeded, EventFailed, EventRetrying, EventCancelled, EventExpired}
+
+// Event is sent to a job's callback URI when the job finishes or is retried
+type Event struct {
+	ID            uuid.UUID  `json:"id"`
+	Type          string     `json:"type"`
+	JobID         uuid.UUID  `json:"job_id"`
+	Status        string     `json:"status"`
+	Try           int        `json:"try"`
+	MaxRetries    int        `json:"max_retries"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	Errors        []string   `json:"errors"`
+	Response      *Response  `json:"response"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// NewEvent returns an event of type for the job's current state
+func NewEvent(eventType string, job *Job) *Event {
+	return &Event{
+		ID:            uuid.NewV4(),
+		Type:          eventType,
+		JobID:         job.ID,
+		Status:        job.Status,
+		Try:           job.Try,
+		MaxRetries:    job.MaxRetries,
+		NextAttemptAt: job.NextAttemptAt,
+		Errors:        job.Errors,
+		Response:      job.Response,
+		CreatedAt:     time.Now(),
+	}
+}
+
+// Callback is an event waiting to be sent to a callback URI
+type Callback struct {
+	TenantID string
+	URI      string
+	Event    *Event
+	Try      int
+}
+
+// JobEvent is an entry in the job event log streamed by GET /events. A stream
+// can be resumed after the last ID it saw. IDs are unique but streams are
+// ordered by the transaction that logged each event, so they do not always
+// increase.
+type JobEvent struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	JobID     uuid.UUID `json:"job_id"`
+	TenantID  string    `json:"tenant_id"`
+	Queue     string    `json:"queue"`
+	Status    string    `json:"status"`
+	Try       int       `json:"try"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -1,21 +1,213 @@
 package types
 
 import (
+	"encoding/json"
+	"fmt"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
+// job statuses
+const (
+	// StatusWaiting jobs wait for the jobs they depend on to finish
+	StatusWaiting   = "waiting"
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// StatusSkipped jobs were never sent because a job they depend on did not
+	// finish the way they required
+	StatusSkipped = "skipped"
+	// StatusCancelled jobs were cancelled before they were sent
+	StatusCancelled = "cancelled"
+	// StatusExpired jobs were not sent or retried after they expired
+	StatusExpired = "expired"
+)
+
+// what happens when a job is created with the dedupe key of a pending job
+const (
+	// DedupeReject rejects the new job
+	DedupeReject = "reject"
+	// DedupeIgnore returns the pending job instead
+	DedupeIgnore = "ignore"
+	// DedupeReplace replaces the pending job's payload and times
+	DedupeReplace = "replace"
+)
+
+// a job runs once every job it depends on has succeeded, or has failed
+const (
+	RunOnSuccess = "success"
+	RunOnFailure = "failure"
+)
+
 // Job contains the information needed to execute a job
 type Job struct {
-	ID        uuid.UUID              `json:"id"`
-	Errors    []string               `json:"errors"`
-	ErrorURI  *string                `json:"error_uri"`
-	ExecuteAt time.Time              `json:"execute_at"`
-	Payload   map[string]interface{} `json:"payload"`
-	Sent      bool                   `json:"sent"`
-	Try       int                    `json:"try"`
-	URI       string                 `json:"uri"`
-	CreatedAt time.Time              `json:"created_at"`
-	UpdatedAt time.Time              `json:"updated_at"`
+	ID              uuid.UUID              `json:"id"`
+	TenantID        string                 `json:"tenant_id"`
+	CallbackEvents  []string               `json:"callback_events"`
+	CallbackURI     *string                `json:"callback_uri"`
+	ConnectTimeout  *Duration              `json:"connect_timeout"`
+	Credential      *string                `json:"credential"`
+	DedupeKey       *string                `json:"dedupe_key"`
+	Delay           *Duration              `json:"delay"`
+	DependsOn       []uuid.UUID            `json:"depends_on"`
+	Errors          []string               `json:"errors"`
+	ErrorURI        *string                `json:"error_uri"`
+	ExecuteAt       time.Time              `json:"execute_at"`
+	ExpiresAt       *time.Time             `json:"expires_at"`
+	MaxLateness     *Duration              `json:"max_lateness"`
+	MaxRetries      int                    `json:"max_retries"`
+	NextAttemptAt   *time.Time             `json:"next_attempt_at"`
+	ParentFields    map[string]string      `json:"parent_fields"`
+	Payload         map[string]interface{} `json:"payload"`
+	Priority        int                    `json:"priority"`
+	Queue           string                 `json:"queue"`
+	RateLimitGroup  *string                `json:"rate_limit_group"`
+	Response        *Response              `json:"response"`
+	RunOn           string                 `json:"run_on"`
+	Sent            bool                   `json:"sent"`
+	Status          string                 `json:"status"`
+	SuccessCriteria *SuccessCriteria       `json:"success_criteria"`
+	Timeout         *Duration              `json:"timeout"`
+	TLSTimeout      *Duration              `json:"tls_timeout"`
+	Try             int                    `json:"try"`
+	URI             string                 `json:"uri"`
+	CreatedAt       time.Time              `json:"created_at"`
+	UpdatedAt       time.Time              `json:"updated_at"`
+
+	// OnSuccess and OnFailure are created with the job and run once it
+	// succeeds or fails. They are only set when the job is created.
+	OnSuccess *Job `json:"on_success,omitempty"`
+	OnFailure *Job `json:"on_failure,omitempty"`
+	// DedupeMode decides what happens when a pending or waiting job has the
+	// same DedupeKey. It is only set when the job is created.
+	DedupeMode string `json:"-"`
+}
+
+// Pending reports whether the job still has to be sent
+func (j *Job) Pending() bool {
+	return j.Status == StatusPending
+}
+
+// Finished reports whether the job will never be sent again
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusSkipped || j.Status == StatusCancelled || j.Status == StatusExpired
+}
+
+// Expired reports whether the job may no longer be sent at t
+func (j *Job) Expired(t time.Time) bool {
+	return j.ExpiresAt != nil && t.After(*j.ExpiresAt)
+}
+
+// Release makes a waiting job pending at now. A delay counts from now and a
+// max lateness from when the job is due, which is now at the earliest, since
+// the job could not run while it was waiting.
+func (j *Job) Release(now time.Time) {
+	j.Status = StatusPending
+
+	if j.Delay != nil {
+		j.ExecuteAt = now.Add(j.Delay.Duration)
+	}
+
+	if j.MaxLateness != nil {
+		due := j.ExecuteAt
+		if due.Before(now) {
+			due = now
+		}
+		expiresAt := due.Add(j.MaxLateness.Duration).UTC()
+		j.ExpiresAt = &expiresAt
+	}
+}
+
+// Expire marks the job expired without sending it
+func (j *Job) Expire() {
+	if j.ExpiresAt != nil {
+		j.Errors = append(j.Errors, fmt.Sprintf("job expired at %s", j.ExpiresAt.Format(time.RFC3339)))
+	} else {
+		j.Errors = append(j.Errors, "job expired")
+	}
+	j.Status = StatusExpired
+}
+
+// Event returns the event a job's callback URI is sent after the job was
+// saved in its current state or "" if there is none
+func (j *Job) Event() string {
+	switch j.Status {
+	case StatusSucceeded:
+		return EventSucceeded
+	case StatusFailed:
+		return EventFailed
+	case StatusCancelled:
+		return EventCancelled
+	case StatusExpired:
+		return EventExpired
+	case StatusPending:
+		if j.Try > 0 {
+			return EventRetrying
+		}
+	}
+
+	return ""
+}
+
+// Notifies reports whether the job's callback URI is sent an event. Every
+// event is sent unless CallbackEvents lists some.
+func (j *Job) Notifies(event string) bool {
+	if j.CallbackURI == nil {
+		return false
+	}
+
+	if len(j.CallbackEvents) == 0 {
+		return true
+	}
+
+	for _, e := range j.CallbackEvents {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DueAt returns when the job should be attempted next
+func (j *Job) DueAt() time.Time {
+	if j.NextAttemptAt != nil {
+		return *j.NextAttemptAt
+	}
+
+	return j.ExecuteAt
+}
+
+// Runs reports whether the job runs after a job it depends on finished with
+// parentStatus
+func (j *Job) Runs(parentStatus string) bool {
+	if j.RunOn == RunOnFailure {
+		return parentStatus == StatusFailed
+	}
+
+	return parentStatus == StatusSucceeded
+}
+
+// CopyParentFields sets the payload keys in ParentFields to the values at
+// their paths in a parent's JSON response body. Paths that do not match are
+// skipped.
+func (j *Job) CopyParentFields(parent *Job) {
+	if len(j.ParentFields) == 0 || parent.Response == nil {
+		return
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(parent.Response.Body), &doc); err != nil {
+		return
+	}
+
+	for key, path := range j.ParentFields {
+		if v, ok := LookupPath(doc, path); ok {
+			if j.Payload == nil {
+				j.Payload = map[string]interface{}{}
+			}
+			j.Payload[key] = v
+		}
+	}
 }
@@ -0,0 +1,72 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobRelease(t *testing.T) {
+	created := time.Date(2018, 10, 1, 9, 0, 0, 0, time.UTC)
+	now := created.Add(10 * time.Minute)
+
+	tests := []struct {
+		name          string
+		job           Job
+		wantExecuteAt time.Time
+		wantExpiresAt *time.Time
+	}{
+		{
+			name:          "delay and max lateness count from the release",
+			job:           Job{ExecuteAt: created.Add(time.Minute), Delay: &Duration{time.Minute}, MaxLateness: &Duration{5 * time.Minute}},
+			wantExecuteAt: now.Add(time.Minute),
+			wantExpiresAt: timePtr(now.Add(6 * time.Minute)),
+		},
+		{
+			name:          "max lateness of an overdue job counts from the release",
+			job:           Job{ExecuteAt: created, MaxLateness: &Duration{5 * time.Minute}},
+			wantExecuteAt: created,
+			wantExpiresAt: timePtr(now.Add(5 * time.Minute)),
+		},
+		{
+			name:          "max lateness of a job due later counts from execute_at",
+			job:           Job{ExecuteAt: now.Add(time.Hour), MaxLateness: &Duration{5 * time.Minute}},
+			wantExecuteAt: now.Add(time.Hour),
+			wantExpiresAt: timePtr(now.Add(time.Hour + 5*time.Minute)),
+		},
+		{
+			name:          "expires_at is kept",
+			job:           Job{ExecuteAt: created, ExpiresAt: timePtr(created.Add(time.Minute))},
+			wantExecuteAt: created,
+			wantExpiresAt: timePtr(created.Add(time.Minute)),
+		},
+	}
+
+	for _, test := range tests {
+		job := test.job
+		job.Status = StatusWaiting
+		job.Release(now)
+
+		if job.Status != StatusPending {
+			t.Errorf("%s: status %s, want %s", test.name, job.Status, StatusPending)
+		}
+		if !job.ExecuteAt.Equal(test.wantExecuteAt) {
+			t.Errorf("%s: execute_at %s, want %s", test.name, job.ExecuteAt, test.wantExecuteAt)
+		}
+		if job.ExpiresAt == nil || !job.ExpiresAt.Equal(*test.wantExpiresAt) {
+			t.Errorf("%s: expires_at %v, want %s", test.name, job.ExpiresAt, test.wantExpiresAt)
+		}
+	}
+}
+
+func TestJobExpireWithoutExpiresAt(t *testing.T) {
+	job := Job{Status: StatusPending}
+	job.Expire()
+
+	if job.Status != StatusExpired || len(job.Errors) != 1 {
+		t.Errorf("expired job %+v, want status %s and an error", job, StatusExpired)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,49 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+)
+
+// LookupPath returns the value at a path in a decoded JSON document. Paths
+// are dot separated keys with optional [n] array indexes, optionally prefixed
+// with "$.", e.g. "$.data.items[0].id".
+func LookupPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return doc, true
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		var indexes []string
+		if i := strings.Index(part, "["); i >= 0 {
+			key = part[:i]
+			indexes = strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][")
+		}
+
+		if key != "" {
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = obj[key]; !ok {
+				return nil, false
+			}
+		}
+
+		for _, index := range indexes {
+			arr, ok := doc.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 || n >= len(arr) {
+				return nil, false
+			}
+			doc = arr[n]
+		}
+	}
+
+	return doc, true
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLookupPath(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{"id": 1, "data": {"items": [{"id": "a"}, {"id": "b"}], "matrix": [[1, 2], [3, 4]]}}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{path: "$", want: doc, wantOK: true},
+		{path: "", want: doc, wantOK: true},
+		{path: "$.id", want: float64(1), wantOK: true},
+		{path: "id", want: float64(1), wantOK: true},
+		{path: "$.data.items[1].id", want: "b", wantOK: true},
+		{path: "$.data.matrix[1][0]", want: float64(3), wantOK: true},
+		{path: "$.data.items[2].id"},
+		{path: "$.data.items[-1]"},
+		{path: "$.data.items[x]"},
+		{path: "$.data.missing"},
+		{path: "$.id.nested"},
+		{path: "$.data[0]"},
+	}
+
+	for _, test := range tests {
+		got, ok := LookupPath(doc, test.path)
+		if ok != test.wantOK || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("LookupPath(%q) = %v, %t, want %v, %t", test.path, got, ok, test.want, test.wantOK)
+		}
+	}
+}
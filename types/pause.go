@@ -0,0 +1,18 @@
+package types
+
+import "time"
+
+// pause scopes
+const (
+	PauseAll   = "all"
+	PauseQueue = "queue"
+	PauseHost  = "host"
+)
+
+// Pause stops the delivery of every job, a queue's jobs or the jobs to hosts
+// matching a pattern. Paused jobs stay pending.
+type Pause struct {
+	Scope     string    `json:"scope"`
+	Target    string    `json:"target"`
+	CreatedAt time.Time `json:"created_at"`
+}
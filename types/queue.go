@@ -0,0 +1,17 @@
+package types
+
+// DefaultQueue is the queue used when a job does not name one
+const DefaultQueue = "default"
+
+// Queue is a named queue's config and load
+type Queue struct {
+	Name       string `json:"name"`
+	WorkerNum  int    `json:"worker_num"`
+	MaxRetries int    `json:"max_retries"`
+	Paused     bool   `json:"paused"`
+	// Depth is the number of pending jobs, Scheduled the number loaded into
+	// memory and InFlight the number claimed and not yet saved
+	Depth     int   `json:"depth"`
+	Scheduled int   `json:"scheduled"`
+	InFlight  int64 `json:"in_flight"`
+}
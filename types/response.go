@@ -0,0 +1,13 @@
+package types
+
+import "time"
+
+// Response is the last response a job's URI returned
+type Response struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	// Truncated is set when the body was cut off at the stored size limit
+	Truncated  bool      `json:"truncated"`
+	ReceivedAt time.Time `json:"received_at"`
+}
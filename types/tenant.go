@@ -0,0 +1,14 @@
+package types
+
+// DefaultTenant is the tenant used when a request does not identify one
+const DefaultTenant = "default"
+
+// Tenant contains the quotas and defaults applied to a tenant's jobs. Nil
+// fields are unlimited or fall back to the processor defaults.
+type Tenant struct {
+	ID             string   `json:"id"`
+	MaxPendingJobs *int     `json:"max_pending_jobs"`
+	DeliveryRate   *float64 `json:"delivery_rate"`
+	MaxRetries     *int     `json:"max_retries"`
+	SigningSecret  *string  `json:"-"`
+}